@@ -0,0 +1,141 @@
+package mongoCounter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	dbUtils "github.com/b-eee/amagi/services/database"
+	influx "github.com/influxdata/influxdb1-client/v2"
+)
+
+type (
+	// counter counters of an operation on a collection since the last write
+	counter struct {
+		count   int
+		errors  int
+		slow    int
+		totalMs float64
+		maxMs   float64
+	}
+
+	counterKey struct {
+		operation  string
+		collection string
+	}
+)
+
+var (
+	// ReportInterval interval of the mongo_queries points
+	ReportInterval = 60 * time.Second
+
+	mu       sync.Mutex
+	counters = map[counterKey]*counter{}
+	started  bool
+)
+
+// InitMongoMonitor record the mongodb operations of the database helpers and write their
+// latency and error counters to influxdb every ReportInterval
+func InitMongoMonitor() error {
+	if err := dbUtils.CreateDatabase(dbUtils.InfluxDB); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if started {
+		return nil
+	}
+	started = true
+
+	dbUtils.SetMongoQueryRecorder(Record)
+	go writeLoop()
+
+	return nil
+}
+
+// Record add the stats of an operation to the counters
+func Record(stats dbUtils.QueryStats) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := counterKey{operation: stats.Operation, collection: stats.Collection}
+	c, ok := counters[key]
+	if !ok {
+		c = &counter{}
+		counters[key] = c
+	}
+
+	ms := float64(stats.Duration) / float64(time.Millisecond)
+	c.count++
+	c.totalMs += ms
+	if ms > c.maxMs {
+		c.maxMs = ms
+	}
+	if stats.Err != nil {
+		c.errors++
+	}
+	if stats.Slow {
+		c.slow++
+	}
+}
+
+func writeLoop() {
+	for range time.Tick(ReportInterval) {
+		if err := write(); err != nil {
+			utils.Warn(fmt.Sprintf("error mongoCounter write %v", err))
+		}
+	}
+}
+
+// write write a point per operation and collection, then reset the counters
+func write() error {
+	if dbUtils.InfluxClient == nil {
+		return nil
+	}
+
+	mu.Lock()
+	current := counters
+	counters = map[counterKey]*counter{}
+	mu.Unlock()
+
+	if len(current) == 0 {
+		return nil
+	}
+
+	bp, err := influx.NewBatchPoints(influx.BatchPointsConfig{
+		Database:  dbUtils.DbNameWHostname(dbUtils.InfluxDB),
+		Precision: "s",
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for key, c := range current {
+		tags := map[string]string{"operation": key.operation, "collection": key.collection}
+		fields := map[string]interface{}{
+			"count":    c.count,
+			"errors":   c.errors,
+			"slow":     c.slow,
+			"total_ms": c.totalMs,
+			"max_ms":   c.maxMs,
+			"avg_ms":   c.totalMs / float64(c.count),
+		}
+		pt, err := influx.NewPoint("mongo_queries", tags, fields, now)
+		if err != nil {
+			utils.Error(fmt.Sprintf("error mongoCounter newpoint %v", err))
+			continue
+		}
+		bp.AddPoint(pt)
+	}
+
+	s := time.Now()
+	if err := dbUtils.InfluxClient.Write(bp); err != nil {
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("mongoCounter write (%v)points success! took %v", len(bp.Points()), time.Since(s)))
+	return nil
+}
@@ -33,6 +33,17 @@ type Environment struct {
 	Source         string `yaml:"source" json:"source"`
 	TLS            string `yaml:"TLS" json:"tls"`
 	ExternalIP     string `yaml:"externalIP" json:"external_ip"`
+
+	// mongodb session settings, durations as "10s"
+	ReadPreference string `yaml:"readPreference" json:"read_preference"`
+	WriteConcern   string `yaml:"writeConcern" json:"write_concern"`
+	WriteJournal   string `yaml:"writeJournal" json:"write_journal"`
+	WriteTimeout   string `yaml:"writeTimeout" json:"write_timeout"`
+	PoolLimit      string `yaml:"poolLimit" json:"pool_limit"`
+	SyncTimeout    string `yaml:"syncTimeout" json:"sync_timeout"`
+	SocketTimeout  string `yaml:"socketTimeout" json:"socket_timeout"`
+	// operations slower than SlowQueryThreshold are logged
+	SlowQueryThreshold string `yaml:"slowQueryThreshold" json:"slow_query_threshold"`
 }
 
 var (
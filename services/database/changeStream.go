@@ -0,0 +1,264 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// ChangeEvent change stream event, FullDocument is set for inserts and replaces, and
+	// for updates when the watch requests FullDocument
+	ChangeEvent struct {
+		Token             bson.Raw            `bson:"_id"`
+		OperationType     string              `bson:"operationType"`
+		Namespace         ChangeNamespace     `bson:"ns"`
+		DocumentKey       bson.M              `bson:"documentKey"`
+		FullDocument      bson.Raw            `bson:"fullDocument"`
+		UpdateDescription *UpdateDescription  `bson:"updateDescription"`
+		ClusterTime       bson.MongoTimestamp `bson:"clusterTime"`
+	}
+
+	// ChangeNamespace database and collection of a change event
+	ChangeNamespace struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	}
+
+	// UpdateDescription fields set and removed by an update
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	}
+
+	// ChangeHandler handle a change event. An error stops the stream, which is reopened
+	// after a backoff from the last handled event, so the failed event is delivered again
+	ChangeHandler func(e *ChangeEvent) error
+
+	// WatchReq change stream request. Name identifies the resume tokens of the watch and
+	// must be stable across restarts. Collection empty watches every collection of Db
+	// existing when the watch starts, each on its own stream
+	WatchReq struct {
+		Name         string
+		Collection   string
+		Pipeline     []bson.M
+		FullDocument bool
+		BatchSize    int
+		MaxAwait     time.Duration
+		MinBackoff   time.Duration
+		MaxBackoff   time.Duration
+		Handler      ChangeHandler
+	}
+
+	// Watcher running change streams of a WatchReq
+	Watcher struct {
+		req  WatchReq
+		done chan struct{}
+		once sync.Once
+		wg   sync.WaitGroup
+	}
+
+	resumeToken struct {
+		ID        string    `bson:"_id"`
+		Token     bson.Raw  `bson:"token"`
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+)
+
+var (
+	// ChangeStreamTokenCollection collection of the resume tokens of the watches
+	ChangeStreamTokenCollection = "change_stream_tokens"
+
+	// DefaultWatchMaxAwait how long a change stream waits for events, bounds the Close latency
+	DefaultWatchMaxAwait = 1 * time.Second
+)
+
+// Watch open change streams on req.Collection, or on the collections of Db, and call
+// req.Handler for each event. The resume token of each handled event is persisted so the
+// watch restarts after the last handled event, the handler must tolerate redeliveries.
+// Change streams require a replica set
+func Watch(req WatchReq) (*Watcher, error) {
+	if req.Name == "" || req.Handler == nil {
+		return nil, fmt.Errorf("Watch requires a Name and a Handler")
+	}
+	if req.MaxAwait <= 0 {
+		req.MaxAwait = DefaultWatchMaxAwait
+	}
+	if req.MinBackoff <= 0 {
+		req.MinBackoff = time.Second
+	}
+	if req.MaxBackoff < req.MinBackoff {
+		req.MaxBackoff = time.Minute
+	}
+
+	collections := []string{req.Collection}
+	if req.Collection == "" {
+		sc := SessionCopy()
+		names, err := sc.DB(Db).CollectionNames()
+		sc.Close()
+		if err != nil {
+			return nil, err
+		}
+		collections = watchCollections(names)
+	}
+
+	w := &Watcher{req: req, done: make(chan struct{})}
+	for _, collection := range collections {
+		w.wg.Add(1)
+		go w.run(collection)
+	}
+
+	utils.Info(fmt.Sprintf("Watch started name=%v collections=%v", req.Name, collections))
+	return w, nil
+}
+
+// Close stop the change streams and wait for the running handlers
+func (w *Watcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	w.wg.Wait()
+
+	return nil
+}
+
+func (w *Watcher) closed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run stream collection until Close, reopening it from the last token after errors
+func (w *Watcher) run(collection string) {
+	defer w.wg.Done()
+
+	key := resumeTokenKey(w.req.Name, collection)
+	backoff := w.req.MinBackoff
+	for !w.closed() {
+		handled, err := w.stream(collection, key)
+		if err == nil {
+			return
+		}
+		if handled {
+			backoff = w.req.MinBackoff
+		}
+
+		utils.Error(fmt.Sprintf("error Watch name=%v collection=%v retry in %v: %v", w.req.Name, collection, backoff, err))
+		select {
+		case <-w.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > w.req.MaxBackoff {
+			backoff = w.req.MaxBackoff
+		}
+	}
+}
+
+// stream consume one change stream of collection, nil once the watcher is closed
+func (w *Watcher) stream(collection, key string) (bool, error) {
+	token, err := loadResumeToken(key)
+	if err != nil {
+		return false, err
+	}
+
+	opts := mongodb.ChangeStreamOptions{
+		ResumeAfter:    token,
+		MaxAwaitTimeMS: w.req.MaxAwait,
+		BatchSize:      w.req.BatchSize,
+	}
+	if w.req.FullDocument {
+		opts.FullDocument = mongodb.UpdateLookup
+	}
+
+	s, sc := BeginMongo()
+	defer sc.Close()
+
+	cs, err := sc.DB(Db).C(collection).Watch(w.req.Pipeline, opts)
+	RecordQuery("watch", collection, nil, s, err)
+	if err != nil {
+		return false, err
+	}
+	defer cs.Close()
+
+	handled := false
+	for {
+		var e ChangeEvent
+		for cs.Next(&e) {
+			if err := w.req.Handler(&e); err != nil {
+				return handled, err
+			}
+			if err := saveResumeToken(key, cs.ResumeToken()); err != nil {
+				return handled, err
+			}
+			handled = true
+
+			if w.closed() {
+				return handled, nil
+			}
+			e = ChangeEvent{}
+		}
+		if err := cs.Err(); err != nil {
+			return handled, err
+		}
+
+		// no event within MaxAwait
+		if w.closed() {
+			return handled, nil
+		}
+	}
+}
+
+func loadResumeToken(key string) (*bson.Raw, error) {
+	conn := BeginMongoWCol()(ChangeStreamTokenCollection)
+	defer conn.Conn.Close()
+
+	var t resumeToken
+	err := conn.Col.FindId(key).One(&t)
+	conn.Record("loadResumeToken", nil, err)
+	if err != nil {
+		if err == mongodb.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &t.Token, nil
+}
+
+func saveResumeToken(key string, token *bson.Raw) error {
+	if token == nil {
+		return nil
+	}
+
+	conn := BeginMongoWCol()(ChangeStreamTokenCollection)
+	defer conn.Conn.Close()
+
+	_, err := conn.Col.UpsertId(key, resumeToken{ID: key, Token: *token, UpdatedAt: time.Now()})
+	conn.Record("saveResumeToken", nil, err)
+	return err
+}
+
+func resumeTokenKey(name, collection string) string {
+	return fmt.Sprintf("%v/%v", name, collection)
+}
+
+// watchCollections collections of a database watch, without the system and token collections
+func watchCollections(names []string) []string {
+	var collections []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || name == ChangeStreamTokenCollection {
+			continue
+		}
+		collections = append(collections, name)
+	}
+
+	return collections
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatchCollections(t *testing.T) {
+	names := []string{"items", "system.views", ChangeStreamTokenCollection, "users"}
+
+	if got := watchCollections(names); !reflect.DeepEqual(got, []string{"items", "users"}) {
+		t.Errorf("watchCollections=%v", got)
+	}
+	if key := resumeTokenKey("reindex", "items"); key != "reindex/items" {
+		t.Errorf("resumeTokenKey=%v", key)
+	}
+}
+
+func TestWatchRequiresHandler(t *testing.T) {
+	if _, err := Watch(WatchReq{Name: "reindex", Collection: "items"}); err == nil {
+		t.Error("Watch without Handler must fail")
+	}
+}
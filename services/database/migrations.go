@@ -0,0 +1,352 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// Migration versioned change of the database, applied once in Version order
+	Migration struct {
+		Version int64
+		Name    string
+		Up      func(db *mongodb.Database) error
+	}
+
+	// AppliedMigration record of an applied migration in MigrationsCollection
+	AppliedMigration struct {
+		Version   int64         `bson:"_id" json:"version"`
+		Name      string        `bson:"name" json:"name"`
+		AppliedAt time.Time     `bson:"applied_at" json:"applied_at"`
+		Duration  time.Duration `bson:"duration" json:"duration"`
+	}
+
+	// MigrationStatus state of a registered migration
+	MigrationStatus struct {
+		Version   int64      `json:"version"`
+		Name      string     `json:"name"`
+		Applied   bool       `json:"applied"`
+		AppliedAt *time.Time `json:"applied_at,omitempty"`
+	}
+
+	// MigrateOptions DryRun lists the pending migrations without running them
+	MigrateOptions struct {
+		DryRun bool
+	}
+
+	migrationLock struct {
+		ID        string    `bson:"_id"`
+		Owner     string    `bson:"owner"`
+		ExpiresAt time.Time `bson:"expires_at"`
+	}
+
+	// migrationHeartbeat refresh the migration lock while the migrations run
+	migrationHeartbeat struct {
+		mu   sync.Mutex
+		err  error
+		quit chan struct{}
+		done chan struct{}
+	}
+)
+
+var (
+	// MigrationsCollection collection of the applied migrations
+	MigrationsCollection = "schema_migrations"
+
+	// MigrationLockCollection collection of the migration lock
+	MigrationLockCollection = "schema_migrations_lock"
+
+	// MigrationLockTTL time after which the lock of a crashed replica is taken over
+	MigrationLockTTL = 10 * time.Minute
+
+	// MigrationLockWait how long a replica waits for another one to finish migrating
+	MigrationLockWait = 15 * time.Minute
+
+	migrationLockID = "migrations"
+
+	errMigrationLockLost = fmt.Errorf("migration lock lost")
+
+	migrationsMu sync.Mutex
+	migrations   = map[int64]Migration{}
+)
+
+// RegisterMigration register a migration, usually from the init of the file defining it
+func RegisterMigration(m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if m.Up == nil {
+		panic(fmt.Sprintf("migration %v %v registered without Up", m.Version, m.Name))
+	}
+	if prev, ok := migrations[m.Version]; ok {
+		panic(fmt.Sprintf("migration version %v registered twice: %v and %v", m.Version, prev.Name, m.Name))
+	}
+	migrations[m.Version] = m
+}
+
+// RegisteredMigrations registered migrations in version order
+func RegisteredMigrations() []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	var all []Migration
+	for _, m := range migrations {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+
+	return all
+}
+
+// GetMigrationStatus status of every registered migration, and of the applied ones not registered anymore
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return migrationStatus(RegisteredMigrations(), applied), nil
+}
+
+// Migrate run the pending migrations in order and return the applied ones. The replicas
+// share a lock, the ones waiting for it find nothing left to run once it is released
+func Migrate(opts MigrateOptions) ([]Migration, error) {
+	all := RegisteredMigrations()
+
+	if opts.DryRun {
+		applied, err := appliedMigrations()
+		if err != nil {
+			return nil, err
+		}
+
+		pending := pendingMigrations(all, applied)
+		for _, m := range pending {
+			utils.Info(fmt.Sprintf("Migrate dry-run pending migration %v %v", m.Version, m.Name))
+		}
+		return pending, nil
+	}
+
+	owner, err := acquireMigrationLock()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseMigrationLock(owner)
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// a long migration must not lose the lock to another replica
+	heartbeat := startMigrationHeartbeat(owner, MigrationLockTTL/3, refreshMigrationLock)
+	defer heartbeat.stop()
+
+	sc := SessionCopy()
+	defer sc.Close()
+	db := sc.DB(Db)
+
+	var done []Migration
+	for _, m := range pendingMigrations(all, applied) {
+		s := time.Now()
+		utils.Info(fmt.Sprintf("Migrate applying migration %v %v", m.Version, m.Name))
+		if err := m.Up(db); err != nil {
+			utils.Error(fmt.Sprintf("error Migrate migration %v %v: %v", m.Version, m.Name, err))
+			return done, fmt.Errorf("migration %v %v failed: %v", m.Version, m.Name, err)
+		}
+
+		record := AppliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now(), Duration: time.Since(s)}
+		rs := time.Now()
+		err := db.C(MigrationsCollection).Insert(record)
+		RecordQuery("insert", MigrationsCollection, nil, rs, err)
+		if err != nil {
+			return done, fmt.Errorf("migration %v %v applied but not recorded: %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+		utils.Info(fmt.Sprintf("Migrate migration %v %v took: %v", m.Version, m.Name, time.Since(s)))
+
+		// another replica may be migrating, stop before the next migration
+		if err := heartbeat.Err(); err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+func appliedMigrations() (map[int64]AppliedMigration, error) {
+	conn := BeginMongoWCol()(MigrationsCollection)
+	defer conn.Conn.Close()
+
+	var records []AppliedMigration
+	err := conn.Col.Find(nil).All(&records)
+	conn.Record("find", nil, err)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int64]AppliedMigration{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+func pendingMigrations(all []Migration, applied map[int64]AppliedMigration) []Migration {
+	var pending []Migration
+	for _, m := range all {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+func migrationStatus(all []Migration, applied map[int64]AppliedMigration) []MigrationStatus {
+	var status []MigrationStatus
+	registered := map[int64]bool{}
+	for _, m := range all {
+		registered[m.Version] = true
+
+		st := MigrationStatus{Version: m.Version, Name: m.Name}
+		if record, ok := applied[m.Version]; ok {
+			appliedAt := record.AppliedAt
+			st.Applied = true
+			st.AppliedAt = &appliedAt
+		}
+		status = append(status, st)
+	}
+
+	for version, record := range applied {
+		if registered[version] {
+			continue
+		}
+		appliedAt := record.AppliedAt
+		status = append(status, MigrationStatus{Version: version, Name: record.Name, Applied: true, AppliedAt: &appliedAt})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return status
+}
+
+// acquireMigrationLock take the lock, waiting up to MigrationLockWait for another replica
+func acquireMigrationLock() (string, error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%v-%v-%v", host, os.Getpid(), bson.NewObjectId().Hex())
+
+	conn := BeginMongoWCol()(MigrationLockCollection)
+	defer conn.Conn.Close()
+
+	deadline := time.Now().Add(MigrationLockWait)
+	for {
+		now := time.Now()
+		err := conn.Col.Insert(migrationLock{ID: migrationLockID, Owner: owner, ExpiresAt: now.Add(MigrationLockTTL)})
+		RecordQuery("acquireLock", MigrationLockCollection, nil, now, err)
+		if err == nil {
+			return owner, nil
+		}
+		if !mongodb.IsDup(err) {
+			return "", err
+		}
+
+		// take over the lock of a replica that died while migrating
+		us := time.Now()
+		selector := bson.M{"_id": migrationLockID, "expires_at": bson.M{"$lt": now}}
+		err = conn.Col.Update(selector, bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(MigrationLockTTL)}})
+		RecordQuery("takeOverLock", MigrationLockCollection, selector, us, err)
+		if err == nil {
+			utils.Info("Migrate took over an expired migration lock")
+			return owner, nil
+		}
+		if err != mongodb.ErrNotFound {
+			return "", err
+		}
+
+		if now.After(deadline) {
+			return "", fmt.Errorf("migration lock not released after %v", MigrationLockWait)
+		}
+		utils.Info("Migrate waiting for another replica to finish migrating")
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func refreshMigrationLock(owner string) error {
+	conn := BeginMongoWCol()(MigrationLockCollection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"_id": migrationLockID, "owner": owner}
+	err := conn.Col.Update(selector, bson.M{"$set": bson.M{"expires_at": time.Now().Add(MigrationLockTTL)}})
+	conn.Record("refreshLock", selector, err)
+	if err == mongodb.ErrNotFound {
+		return errMigrationLockLost
+	}
+
+	return err
+}
+
+// startMigrationHeartbeat refresh the lock of owner every interval until stopped. Refresh
+// errors are retried on the next tick, a lost lock stops the heartbeat and is kept for Err
+func startMigrationHeartbeat(owner string, interval time.Duration, refresh func(owner string) error) *migrationHeartbeat {
+	hb := &migrationHeartbeat{quit: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(hb.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hb.quit:
+				return
+			case <-ticker.C:
+			}
+
+			err := refresh(owner)
+			if err == errMigrationLockLost {
+				utils.Error("error Migrate migration lock lost to another replica")
+				hb.mu.Lock()
+				hb.err = err
+				hb.mu.Unlock()
+				return
+			}
+			if err != nil {
+				utils.Error(fmt.Sprintf("error Migrate refresh lock %v", err))
+			}
+		}
+	}()
+
+	return hb
+}
+
+// Err errMigrationLockLost once the lock was lost
+func (hb *migrationHeartbeat) Err() error {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	return hb.err
+}
+
+func (hb *migrationHeartbeat) stop() {
+	close(hb.quit)
+	<-hb.done
+}
+
+func releaseMigrationLock(owner string) {
+	conn := BeginMongoWCol()(MigrationLockCollection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"_id": migrationLockID, "owner": owner}
+	err := conn.Col.Remove(selector)
+	conn.Record("releaseLock", selector, err)
+	if err != nil && err != mongodb.ErrNotFound {
+		utils.Error(fmt.Sprintf("error Migrate release lock %v", err))
+	}
+}
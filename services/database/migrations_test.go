@@ -0,0 +1,89 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mongodb "github.com/globalsign/mgo"
+)
+
+func TestMigrationStatus(t *testing.T) {
+	up := func(db *mongodb.Database) error { return nil }
+	all := []Migration{
+		{Version: 1, Name: "create_users", Up: up},
+		{Version: 2, Name: "index_users_email", Up: up},
+		{Version: 3, Name: "create_orders", Up: up},
+	}
+	applied := map[int64]AppliedMigration{
+		1: {Version: 1, Name: "create_users", AppliedAt: time.Now()},
+		// applied by a newer release, no longer registered here
+		4: {Version: 4, Name: "removed", AppliedAt: time.Now()},
+	}
+
+	pending := pendingMigrations(all, applied)
+	if len(pending) != 2 || pending[0].Version != 2 || pending[1].Version != 3 {
+		t.Errorf("pending=%+v, want 2 and 3", pending)
+	}
+
+	status := migrationStatus(all, applied)
+	if len(status) != 4 {
+		t.Fatalf("status=%+v", status)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if status[i].Version != int64(i+1) || status[i].Applied != want {
+			t.Errorf("status[%v]=%+v, want applied=%v", i, status[i], want)
+		}
+	}
+}
+
+func TestRegisterMigration(t *testing.T) {
+	RegisterMigration(Migration{Version: 20200102, Name: "b", Up: func(*mongodb.Database) error { return nil }})
+	RegisterMigration(Migration{Version: 20200101, Name: "a", Up: func(*mongodb.Database) error { return nil }})
+
+	registered := RegisteredMigrations()
+	if len(registered) < 2 || registered[0].Version != 20200101 {
+		t.Errorf("migrations not in version order %+v", registered)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a version twice must panic")
+		}
+	}()
+	RegisterMigration(Migration{Version: 20200101, Name: "c", Up: func(*mongodb.Database) error { return nil }})
+}
+
+func TestMigrationHeartbeat(t *testing.T) {
+	var mu sync.Mutex
+	refreshes := 0
+	hb := startMigrationHeartbeat("owner", time.Millisecond, func(owner string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshes++
+		switch refreshes {
+		case 1:
+			return nil
+		case 2:
+			return fmt.Errorf("network error")
+		}
+		return errMigrationLockLost
+	})
+	defer hb.stop()
+
+	deadline := time.Now().Add(time.Second)
+	for hb.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("lost lock not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes != 3 {
+		t.Errorf("refreshes=%v, want 3, the heartbeat stops once the lock is lost", refreshes)
+	}
+}
@@ -31,8 +31,6 @@ var (
 	ensureMaxWrite     = 1
 	defaultMongodbPort = "27017"
 
-	maxSyncTimeout time.Duration = 1
-
 	// JournalPatternDB journal pattern database prefix name
 	JournalPatternDB = "journal"
 
@@ -72,6 +70,19 @@ func MongodbStart() {
 	}
 
 	setDatabaseName(cfe)
+
+	opts, err := sessionOptionsFromConfig(cfe)
+	if err != nil {
+		panic(fmt.Sprintf("invalid mongodb session options:%v", err))
+	}
+	MongoSessionOptions = opts
+	if err := setSlowQueryThreshold(cfe); err != nil {
+		panic(err)
+	}
+	if opts.PoolLimit > 0 {
+		session.SetPoolLimit(opts.PoolLimit)
+	}
+
 	utils.Info(fmt.Sprintf("connected to mongodb... %v(db:%s)", host, Db))
 
 	// MongodbSession.SetMode(mongodb.Monotonic, true)
@@ -185,22 +196,9 @@ func IsConnected() bool {
 	return connected
 }
 
-// SessionCopy make copy of a mongodb session
+// SessionCopy make copy of a mongodb session with MongoSessionOptions
 func SessionCopy() *mongodb.Session {
-	// TRIAL prevent connection drop on master reschedule(on replica) -JP
-	MongodbSession.Refresh()
-
-	sc := MongodbSession.Copy()
-
-	// setMode ref: https://godoc.org/labix.org/v2/mgo#Session.SetMode
-	// sc.SetMode(mongodb.PrimaryPreferred, true)
-
-	// https://godoc.org/labix.org/v2/mgo#Session.SetSafe
-	// W: 2  atleast two instances confirm of writes
-	// sc.SetSafe(&mongodb.Safe{WMode: "majority", W: ensureMaxWrite, FSync: true})
-	sc.SetSyncTimeout(maxSyncTimeout * time.Second)
-	sc.SetSocketTimeout(maxSyncTimeout * time.Hour)
-	return sc
+	return SessionCopyWith(SessionOptions{})
 }
 
 func printLiveServers(session *mongodb.Session) {
@@ -251,7 +249,9 @@ func MongoInsert(collection string, data ...interface{}) error {
 	c := sc.DB(Db).C(collection)
 	defer sc.Close()
 
-	if err := c.Insert(data...); err != nil {
+	err := c.Insert(data...)
+	RecordQuery("insert", collection, nil, s, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("error MongoInsert %v collection: %v", err, collection))
 		return err
 	}
@@ -266,7 +266,9 @@ func MongoUpdate(collection string, selector interface{}, update interface{}) er
 	c := sc.DB(Db).C(collection)
 	defer sc.Close()
 
-	if err := c.Update(selector, update); err != nil {
+	err := c.Update(selector, update)
+	RecordQuery("update", collection, selector, s, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("error MongoUpdate %v collection: %v", err, collection))
 		return err
 	}
@@ -281,7 +283,9 @@ func MongoRemove(collection string, selector interface{}) error {
 	c := sc.DB(Db).C(collection)
 	defer sc.Close()
 
-	if err := c.Remove(selector); err != nil {
+	err := c.Remove(selector)
+	RecordQuery("remove", collection, selector, s, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("error MongoRemove on selector %v", err))
 		return err
 	}
@@ -297,7 +301,9 @@ func MongoCreateCollection(collection string, info *mongodb.CollectionInfo) erro
 	defer sc.Close()
 
 	// info := mgo.CollectionInfo{ForceIdIndex: false, DisableIdIndex: true}
-	if err := c.Create(info); err != nil {
+	err := c.Create(info)
+	RecordQuery("create", collection, nil, s, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("error MongoCreateCollection %v", err))
 		return err
 	}
@@ -314,6 +320,7 @@ func CountCollection(collection string, query bson.M) int {
 	defer sc.Close()
 
 	count, err := c.Find(query).Count()
+	RecordQuery("count", collection, query, s, err)
 	if err != nil {
 		utils.Error(fmt.Sprintf("error CountCollection %v", err))
 		return 0
@@ -329,7 +336,9 @@ func MongoEnsureIndex(collection string, index mongodb.Index) error {
 	c := sc.DB(Db).C(collection)
 	defer sc.Close()
 
-	if err := c.EnsureIndex(index); err != nil {
+	err := c.EnsureIndex(index)
+	RecordQuery("ensureIndex", collection, nil, s, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("error MongoEnsureIndex %v", err))
 		return err
 	}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	config "github.com/b-eee/amagi/services/configctl"
+
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// QueryStats outcome of a mongodb operation of the database helpers
+	QueryStats struct {
+		Operation  string
+		Collection string
+		Duration   time.Duration
+		Slow       bool
+		Err        error
+	}
+
+	// QueryRecorder receive the stats of every mongodb operation, e.g. to push them to influxdb
+	QueryRecorder func(stats QueryStats)
+)
+
+var (
+	// SlowQueryThreshold operations taking longer are logged with their redacted selector
+	SlowQueryThreshold = 500 * time.Millisecond
+
+	// MongodbSlowQueryENV slow query threshold env
+	MongodbSlowQueryENV = "MONGODB_SLOW_QUERY"
+
+	redactedValue = "?"
+
+	// mongoQueryRecorder QueryRecorder of the mongodb operations, see SetMongoQueryRecorder
+	mongoQueryRecorder atomic.Value
+)
+
+// SetMongoQueryRecorder set the recorder of the mongodb operations, nil to only log the slow ones
+func SetMongoQueryRecorder(recorder QueryRecorder) {
+	mongoQueryRecorder.Store(recorder)
+}
+
+// setSlowQueryThreshold threshold of cfe, the env overriding the config
+func setSlowQueryThreshold(cfe config.Environment) error {
+	value := cfe.SlowQueryThreshold
+	if env := os.Getenv(MongodbSlowQueryENV); env != "" {
+		value = env
+	}
+	if value == "" {
+		return nil
+	}
+
+	threshold, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid mongodb slow query threshold %v", value)
+	}
+	SlowQueryThreshold = threshold
+
+	return nil
+}
+
+// RecordQuery record an operation started at s, selector is logged redacted when it is slow.
+// ErrNotFound is a result, not an error
+func RecordQuery(op, collection string, selector interface{}, s time.Time, err error) {
+	stats := QueryStats{Operation: op, Collection: collection, Duration: time.Since(s)}
+	if err != nil && err != mongodb.ErrNotFound {
+		stats.Err = err
+	}
+	stats.Slow = SlowQueryThreshold > 0 && stats.Duration >= SlowQueryThreshold
+
+	if stats.Slow {
+		utils.Warn(fmt.Sprintf("slow mongodb query op=%v collection=%v took: %v selector=%v",
+			op, collection, stats.Duration, redactSelector(selector)))
+	}
+
+	if recorder, _ := mongoQueryRecorder.Load().(QueryRecorder); recorder != nil {
+		recorder(stats)
+	}
+}
+
+// redactSelector selector with its keys and operators kept and its values replaced,
+// so the slow query log shows the query shape without the user data
+func redactSelector(selector interface{}) interface{} {
+	switch v := selector.(type) {
+	case nil:
+		return nil
+	case bson.M:
+		return redactMap(v)
+	case map[string]interface{}:
+		return redactMap(v)
+	case bson.D:
+		redacted := bson.D{}
+		for _, e := range v {
+			redacted = append(redacted, bson.DocElem{Name: e.Name, Value: redactSelector(e.Value)})
+		}
+		return redacted
+	case []bson.M:
+		var redacted []interface{}
+		for _, m := range v {
+			redacted = append(redacted, redactMap(m))
+		}
+		return redacted
+	case []interface{}:
+		var redacted []interface{}
+		for _, e := range v {
+			redacted = append(redacted, redactSelector(e))
+		}
+		return redacted
+	}
+
+	// structs and typed maps by their bson document
+	raw, err := bson.Marshal(selector)
+	if err != nil {
+		return redactedValue
+	}
+	var m bson.M
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		return redactedValue
+	}
+
+	return redactMap(m)
+}
+
+func redactMap(m map[string]interface{}) bson.M {
+	redacted := bson.M{}
+	for k, v := range m {
+		switch v.(type) {
+		case bson.M, map[string]interface{}, bson.D, []bson.M, []interface{}:
+			redacted[k] = redactSelector(v)
+		default:
+			redacted[k] = redactedValue
+		}
+	}
+
+	return redacted
+}
+
+// Record record an operation on Col started at Time, for the helpers using BeginMongoWCol
+func (conn BeginMongoConn) Record(op string, selector interface{}, err error) {
+	RecordQuery(op, conn.Col.Name, selector, conn.Time, err)
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestRedactSelector(t *testing.T) {
+	selector := bson.M{
+		"email": "user@example.com",
+		"age":   bson.M{"$gt": 20},
+		"$or":   []bson.M{{"name": "a"}, {"name": "b"}},
+	}
+
+	want := bson.M{
+		"email": "?",
+		"age":   bson.M{"$gt": "?"},
+		"$or":   []interface{}{bson.M{"name": "?"}, bson.M{"name": "?"}},
+	}
+	if got := redactSelector(selector); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactSelector=%v, want %v", got, want)
+	}
+
+	type byName struct {
+		Name string `bson:"name"`
+	}
+	if got := redactSelector(byName{Name: "secret"}); !reflect.DeepEqual(got, bson.M{"name": "?"}) {
+		t.Errorf("redactSelector struct=%v", got)
+	}
+}
+
+func TestRecordQuery(t *testing.T) {
+	var recorded []QueryStats
+	SetMongoQueryRecorder(func(stats QueryStats) { recorded = append(recorded, stats) })
+	defer SetMongoQueryRecorder(nil)
+
+	RecordQuery("findOne", "items", bson.M{"_id": 1}, time.Now(), mongodb.ErrNotFound)
+	RecordQuery("find", "items", nil, time.Now().Add(-2*SlowQueryThreshold), errors.New("boom"))
+	BeginMongoConn{Time: time.Now(), Col: &mongodb.Collection{Name: "tasks"}}.Record("count", nil, nil)
+
+	if len(recorded) != 3 {
+		t.Fatalf("recorded=%+v", recorded)
+	}
+	if recorded[0].Err != nil || recorded[0].Slow {
+		t.Errorf("not found must not count as an error %+v", recorded[0])
+	}
+	if recorded[1].Err == nil || !recorded[1].Slow || recorded[1].Operation != "find" || recorded[1].Collection != "items" {
+		t.Errorf("stats=%+v", recorded[1])
+	}
+	if recorded[2].Operation != "count" || recorded[2].Collection != "tasks" {
+		t.Errorf("BeginMongoConn.Record stats=%+v", recorded[2])
+	}
+}
+
+func TestSetMongoQueryRecorderConcurrent(t *testing.T) {
+	defer SetMongoQueryRecorder(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetMongoQueryRecorder(func(stats QueryStats) {})
+		}()
+		go func() {
+			defer wg.Done()
+			RecordQuery("find", "items", nil, time.Now(), nil)
+		}()
+	}
+	wg.Wait()
+}
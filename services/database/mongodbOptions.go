@@ -0,0 +1,251 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	config "github.com/b-eee/amagi/services/configctl"
+
+	mongodb "github.com/globalsign/mgo"
+)
+
+type (
+	// SessionOptions read preference, write concern, pool limit and timeouts of a mongodb
+	// session. Zero fields keep the value of MongoSessionOptions
+	SessionOptions struct {
+		// ReadPreference primary, primaryPreferred, secondary, secondaryPreferred or nearest
+		ReadPreference string
+		Safe           *mongodb.Safe
+		PoolLimit      int
+		SyncTimeout    time.Duration
+		SocketTimeout  time.Duration
+	}
+)
+
+var (
+	// MongoSessionOptions options of the sessions copied by SessionCopy, set from the
+	// mongodb config and the MONGODB_* env by MongodbStart
+	MongoSessionOptions = SessionOptions{
+		SyncTimeout:   1 * time.Second,
+		SocketTimeout: 1 * time.Hour,
+	}
+
+	// MongodbReadPreferenceENV read preference env
+	MongodbReadPreferenceENV = "MONGODB_READ_PREFERENCE"
+
+	// MongodbWriteConcernENV write concern env, a number of instances or a mode like majority
+	MongodbWriteConcernENV = "MONGODB_WRITE_CONCERN"
+
+	// MongodbWriteJournalENV write concern journal env, true or false
+	MongodbWriteJournalENV = "MONGODB_WRITE_JOURNAL"
+
+	// MongodbWriteTimeoutENV write concern timeout env
+	MongodbWriteTimeoutENV = "MONGODB_WRITE_TIMEOUT"
+
+	// MongodbPoolLimitENV socket pool limit per server env
+	MongodbPoolLimitENV = "MONGODB_POOL_LIMIT"
+
+	// MongodbSyncTimeoutENV server selection timeout env
+	MongodbSyncTimeoutENV = "MONGODB_SYNC_TIMEOUT"
+
+	// MongodbSocketTimeoutENV socket read/write timeout env
+	MongodbSocketTimeoutENV = "MONGODB_SOCKET_TIMEOUT"
+
+	readPreferences = map[string]mongodb.Mode{
+		"primary":            mongodb.Primary,
+		"primarypreferred":   mongodb.PrimaryPreferred,
+		"secondary":          mongodb.Secondary,
+		"secondarypreferred": mongodb.SecondaryPreferred,
+		"nearest":            mongodb.Nearest,
+		"eventual":           mongodb.Eventual,
+		"monotonic":          mongodb.Monotonic,
+		"strong":             mongodb.Strong,
+	}
+)
+
+// SessionCopyWith copy of the mongodb session with opts applied over MongoSessionOptions,
+// e.g. SessionOptions{ReadPreference: "secondaryPreferred"} for reporting queries.
+// An invalid read preference is logged and the session mode kept, see Validate
+func SessionCopyWith(opts SessionOptions) *mongodb.Session {
+	// TRIAL prevent connection drop on master reschedule(on replica) -JP
+	MongodbSession.Refresh()
+
+	sc := MongodbSession.Copy()
+	if err := applySessionOptions(sc, MongoSessionOptions.merge(opts)); err != nil {
+		utils.Error(fmt.Sprintf("error SessionCopyWith %v, keeping the session mode", err))
+	}
+	return sc
+}
+
+// Validate check the read preference of o, to reject invalid options before using them
+func (o SessionOptions) Validate() error {
+	if o.ReadPreference == "" {
+		return nil
+	}
+
+	_, err := parseReadPreference(o.ReadPreference)
+	return err
+}
+
+// BeginMongoWColWith BeginMongoWCol with session options
+func BeginMongoWColWith(opts SessionOptions) func(string) BeginMongoConn {
+	return func(cname string) BeginMongoConn {
+		conn := SessionCopyWith(opts)
+		return BeginMongoConn{time.Now(), conn, conn.DB(Db).C(cname)}
+	}
+}
+
+// MajorityWrite write concern acknowledged by the majority of the replica set, journaled
+func MajorityWrite(timeout time.Duration) SessionOptions {
+	return SessionOptions{Safe: &mongodb.Safe{WMode: "majority", J: true, WTimeout: int(timeout / time.Millisecond)}}
+}
+
+// merge o overridden by the set fields of override
+func (o SessionOptions) merge(override SessionOptions) SessionOptions {
+	if override.ReadPreference != "" {
+		o.ReadPreference = override.ReadPreference
+	}
+	if override.Safe != nil {
+		o.Safe = override.Safe
+	}
+	if override.PoolLimit > 0 {
+		o.PoolLimit = override.PoolLimit
+	}
+	if override.SyncTimeout > 0 {
+		o.SyncTimeout = override.SyncTimeout
+	}
+	if override.SocketTimeout > 0 {
+		o.SocketTimeout = override.SocketTimeout
+	}
+
+	return o
+}
+
+// applySessionOptions set opts on sc, an invalid read preference is returned after the
+// other options are applied, the session keeping its mode
+func applySessionOptions(sc *mongodb.Session, opts SessionOptions) error {
+	var err error
+	if opts.ReadPreference != "" {
+		var mode mongodb.Mode
+		if mode, err = parseReadPreference(opts.ReadPreference); err == nil {
+			sc.SetMode(mode, true)
+		}
+	}
+	if opts.Safe != nil {
+		sc.SetSafe(opts.Safe)
+	}
+	if opts.PoolLimit > 0 {
+		sc.SetPoolLimit(opts.PoolLimit)
+	}
+	if opts.SyncTimeout > 0 {
+		sc.SetSyncTimeout(opts.SyncTimeout)
+	}
+	if opts.SocketTimeout > 0 {
+		sc.SetSocketTimeout(opts.SocketTimeout)
+	}
+
+	return err
+}
+
+// sessionOptionsFromConfig session options of cfe, the MONGODB_* env overriding the config
+func sessionOptionsFromConfig(cfe config.Environment) (SessionOptions, error) {
+	opts := MongoSessionOptions
+
+	readPreference := envOr(MongodbReadPreferenceENV, cfe.ReadPreference)
+	if readPreference != "" {
+		if _, err := parseReadPreference(readPreference); err != nil {
+			return opts, err
+		}
+		opts.ReadPreference = readPreference
+	}
+
+	safe, err := parseWriteConcern(
+		envOr(MongodbWriteConcernENV, cfe.WriteConcern),
+		envOr(MongodbWriteJournalENV, cfe.WriteJournal),
+		envOr(MongodbWriteTimeoutENV, cfe.WriteTimeout),
+	)
+	if err != nil {
+		return opts, err
+	}
+	if safe != nil {
+		opts.Safe = safe
+	}
+
+	if poolLimit := envOr(MongodbPoolLimitENV, cfe.PoolLimit); poolLimit != "" {
+		if opts.PoolLimit, err = strconv.Atoi(poolLimit); err != nil {
+			return opts, fmt.Errorf("invalid mongodb pool limit %v", poolLimit)
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"sync timeout", envOr(MongodbSyncTimeoutENV, cfe.SyncTimeout), &opts.SyncTimeout},
+		{"socket timeout", envOr(MongodbSocketTimeoutENV, cfe.SocketTimeout), &opts.SocketTimeout},
+	} {
+		if t.value == "" {
+			continue
+		}
+		if *t.dest, err = time.ParseDuration(t.value); err != nil {
+			return opts, fmt.Errorf("invalid mongodb %v %v", t.name, t.value)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseReadPreference(value string) (mongodb.Mode, error) {
+	mode, ok := readPreferences[strings.ToLower(value)]
+	if !ok {
+		return mode, fmt.Errorf("invalid mongodb read preference %v", value)
+	}
+
+	return mode, nil
+}
+
+// parseWriteConcern write concern of w (a number of instances or a mode like majority),
+// j and wtimeout, nil when none is set
+func parseWriteConcern(w, j, wtimeout string) (*mongodb.Safe, error) {
+	if w == "" && j == "" && wtimeout == "" {
+		return nil, nil
+	}
+
+	safe := &mongodb.Safe{}
+	if n, err := strconv.Atoi(w); err == nil {
+		safe.W = n
+	} else {
+		safe.WMode = w
+	}
+
+	if j != "" {
+		journal, err := strconv.ParseBool(j)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongodb write journal %v", j)
+		}
+		safe.J = journal
+	}
+
+	if wtimeout != "" {
+		timeout, err := time.ParseDuration(wtimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongodb write timeout %v", wtimeout)
+		}
+		safe.WTimeout = int(timeout / time.Millisecond)
+	}
+
+	return safe, nil
+}
+
+func envOr(name, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+
+	return value
+}
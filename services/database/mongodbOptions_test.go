@@ -0,0 +1,84 @@
+package database
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	config "github.com/b-eee/amagi/services/configctl"
+	mongodb "github.com/globalsign/mgo"
+)
+
+func TestSessionOptionsFromConfig(t *testing.T) {
+	os.Setenv(MongodbSyncTimeoutENV, "5s")
+	defer os.Unsetenv(MongodbSyncTimeoutENV)
+
+	opts, err := sessionOptionsFromConfig(config.Environment{
+		ReadPreference: "secondaryPreferred",
+		WriteConcern:   "majority",
+		WriteJournal:   "true",
+		WriteTimeout:   "2s",
+		PoolLimit:      "64",
+		SyncTimeout:    "3s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.ReadPreference != "secondaryPreferred" || opts.PoolLimit != 64 {
+		t.Errorf("opts=%+v", opts)
+	}
+	if opts.Safe == nil || opts.Safe.WMode != "majority" || !opts.Safe.J || opts.Safe.WTimeout != 2000 {
+		t.Errorf("safe=%+v", opts.Safe)
+	}
+	// env over config, defaults kept when unset
+	if opts.SyncTimeout != 5*time.Second || opts.SocketTimeout != time.Hour {
+		t.Errorf("sync=%v socket=%v", opts.SyncTimeout, opts.SocketTimeout)
+	}
+
+	for _, cfe := range []config.Environment{
+		{ReadPreference: "anywhere"},
+		{WriteJournal: "maybe"},
+		{PoolLimit: "many"},
+		{SocketTimeout: "1"},
+	} {
+		if _, err := sessionOptionsFromConfig(cfe); err == nil {
+			t.Errorf("expected error for %+v", cfe)
+		}
+	}
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	safe, err := parseWriteConcern("2", "", "")
+	if err != nil || safe.W != 2 || safe.WMode != "" {
+		t.Errorf("safe=%+v err=%v", safe, err)
+	}
+
+	if safe, err := parseWriteConcern("", "", ""); safe != nil || err != nil {
+		t.Errorf("unset write concern safe=%+v err=%v", safe, err)
+	}
+}
+
+func TestSessionOptionsMerge(t *testing.T) {
+	base := SessionOptions{ReadPreference: "primary", SyncTimeout: time.Second, SocketTimeout: time.Hour}
+
+	merged := base.merge(SessionOptions{ReadPreference: "secondary", Safe: &mongodb.Safe{WMode: "majority"}})
+	if merged.ReadPreference != "secondary" || merged.Safe.WMode != "majority" || merged.SyncTimeout != time.Second {
+		t.Errorf("merged=%+v", merged)
+	}
+
+	if repo := NewRepository("items").WithOptions(MajorityWrite(time.Second)); repo.Options.Safe.WTimeout != 1000 {
+		t.Errorf("repository options=%+v", repo.Options)
+	}
+}
+
+func TestSessionOptionsValidate(t *testing.T) {
+	for _, opts := range []SessionOptions{{}, {ReadPreference: "secondaryPreferred"}, {ReadPreference: "Nearest"}} {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Validate(%+v)=%v", opts, err)
+		}
+	}
+	if err := (SessionOptions{ReadPreference: "anywhere"}).Validate(); err == nil {
+		t.Error("an invalid read preference must be rejected")
+	}
+}
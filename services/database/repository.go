@@ -0,0 +1,461 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// Repository find, write and aggregate helpers of a collection. Results are decoded
+	// into the struct or slice pointer given by the caller, like mgo Query.One and All
+	Repository struct {
+		Collection string
+		Options    SessionOptions
+
+		// SoftDelete the find and update helpers exclude the documents with DeletedAtField,
+		// Upsert restores a soft-deleted match instead of inserting a duplicate
+		SoftDelete bool
+
+		// Versioned UpdateByID, Upsert and BulkWrite updates increment VersionField
+		Versioned bool
+	}
+
+	// FindOptions projection, sort (mgo sort fields, "-" prefix for descending), skip and limit of a find
+	FindOptions struct {
+		Projection interface{}
+		Sort       []string
+		Skip       int
+		Limit      int
+	}
+
+	// PageRequest keyset pagination request ordered by SortField then _id, Cursor is the
+	// NextCursor of the previous page, empty for the first page
+	PageRequest struct {
+		Selector   bson.M
+		Projection interface{}
+		SortField  string
+		Desc       bool
+		Limit      int
+		Cursor     string
+	}
+
+	// Page keyset pagination state of a FindPage result
+	Page struct {
+		NextCursor string
+		HasMore    bool
+	}
+
+	// BulkOp one operation of BulkWrite: Insert a document, or Update/Upsert/Remove by Selector
+	BulkOp struct {
+		Insert   interface{}
+		Selector interface{}
+		Update   interface{}
+		Upsert   bool
+		Remove   bool
+		Multi    bool
+	}
+
+	pageCursor struct {
+		Value interface{} `bson:"v"`
+		ID    interface{} `bson:"id"`
+	}
+)
+
+var (
+	// DefaultPageLimit page size of FindPage when the request has none
+	DefaultPageLimit = 50
+)
+
+// NewRepository repository of collection in Db
+func NewRepository(collection string) *Repository {
+	return &Repository{Collection: collection}
+}
+
+// WithOptions copy of the repository with session options, e.g. a secondary read
+// preference for reporting queries or MajorityWrite for critical writes
+func (r *Repository) WithOptions(opts SessionOptions) *Repository {
+	copied := *r
+	copied.Options = r.Options.merge(opts)
+	return &copied
+}
+
+func (r *Repository) begin() BeginMongoConn {
+	return BeginMongoWColWith(r.Options)(r.Collection)
+}
+
+func (r *Repository) query(col *mongodb.Collection, selector interface{}, opts FindOptions) *mongodb.Query {
+	q := col.Find(selector)
+	if opts.Projection != nil {
+		q = q.Select(opts.Projection)
+	}
+	if len(opts.Sort) != 0 {
+		q = q.Sort(opts.Sort...)
+	}
+	if opts.Skip > 0 {
+		q = q.Skip(opts.Skip)
+	}
+	if opts.Limit > 0 {
+		q = q.Limit(opts.Limit)
+	}
+
+	return q
+}
+
+// FindOne decode the first document matching selector into result, mgo.ErrNotFound when none
+func (r *Repository) FindOne(selector interface{}, opts FindOptions, result interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := r.query(conn.Col, r.notDeleted(selector), opts).One(result)
+	RecordQuery("findOne", r.Collection, selector, conn.Time, err)
+	if err != nil {
+		if err != mongodb.ErrNotFound {
+			utils.Error(fmt.Sprintf("error Repository.FindOne %v collection: %v", err, r.Collection))
+		}
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.FindOne took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// FindByID decode the document with _id id into result
+func (r *Repository) FindByID(id interface{}, result interface{}) error {
+	return r.FindOne(bson.M{"_id": id}, FindOptions{}, result)
+}
+
+// Find decode the documents matching selector into results, a pointer to a slice
+func (r *Repository) Find(selector interface{}, opts FindOptions, results interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := r.query(conn.Col, r.notDeleted(selector), opts).All(results)
+	RecordQuery("find", r.Collection, selector, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.Find %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.Find took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// Count count the documents matching selector
+func (r *Repository) Count(selector interface{}) (int, error) {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	count, err := conn.Col.Find(r.notDeleted(selector)).Count()
+	RecordQuery("count", r.Collection, selector, conn.Time, err)
+	return count, err
+}
+
+// FindPage decode a page of the documents matching req.Selector into results, a pointer to a
+// slice. Pages are read after the cursor instead of skipping, so they stay fast and stable
+// while documents are inserted. SortField values must be comparable and set on every document
+func (r *Repository) FindPage(req PageRequest, results interface{}) (Page, error) {
+	rv := reflect.ValueOf(results)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return Page{}, fmt.Errorf("FindPage results must be a pointer to a slice, got %T", results)
+	}
+
+	if req.SortField == "" {
+		req.SortField = "_id"
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultPageLimit
+	}
+
+	selector, err := pageSelector(req)
+	if err != nil {
+		return Page{}, err
+	}
+
+	// one more document tells whether there is a next page
+	opts := FindOptions{Projection: req.Projection, Sort: pageSort(req), Limit: req.Limit + 1}
+	if err := r.Find(selector, opts, results); err != nil {
+		return Page{}, err
+	}
+
+	slice := rv.Elem()
+	if slice.Len() <= req.Limit {
+		return Page{}, nil
+	}
+	slice.Set(slice.Slice(0, req.Limit))
+
+	cursor, err := encodePageCursor(slice.Index(req.Limit-1).Interface(), req.SortField)
+	if err != nil {
+		return Page{}, err
+	}
+
+	return Page{NextCursor: cursor, HasMore: true}, nil
+}
+
+// Insert insert the documents
+func (r *Repository) Insert(docs ...interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := conn.Col.Insert(docs...)
+	RecordQuery("insert", r.Collection, nil, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.Insert %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.Insert took: %v collection: %v len(%v)", time.Since(conn.Time), r.Collection, len(docs)))
+	return nil
+}
+
+// UpdateByID apply update to the document with _id id
+func (r *Repository) UpdateByID(id interface{}, update interface{}) error {
+	update, err := r.writeUpdate(update)
+	if err != nil {
+		return err
+	}
+
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	selector := bson.M{"_id": id}
+	err = conn.Col.Update(r.notDeleted(selector), update)
+	RecordQuery("update", r.Collection, selector, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.UpdateByID %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.UpdateByID took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// RemoveByID remove the document with _id id
+func (r *Repository) RemoveByID(id interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := conn.Col.RemoveId(id)
+	RecordQuery("remove", r.Collection, bson.M{"_id": id}, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.RemoveByID %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.RemoveByID took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// Upsert update the first document matching selector, inserting it when none matches.
+// With SoftDelete a soft-deleted match is updated and restored
+func (r *Repository) Upsert(selector interface{}, update interface{}) (*mongodb.ChangeInfo, error) {
+	update, err := r.writeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	info, err := conn.Col.Upsert(selector, r.restoreUpdate(selector, update))
+	RecordQuery("upsert", r.Collection, selector, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.Upsert %v collection: %v", err, r.Collection))
+		return nil, err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.Upsert took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return info, nil
+}
+
+// BulkWrite run ops in a single bulk, ordered stops at the first failing operation.
+// Updates are applied like UpdateByID and Upsert, removes delete permanently
+func (r *Repository) BulkWrite(ops []BulkOp, ordered bool) (*mongodb.BulkResult, error) {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	bulk := conn.Col.Bulk()
+	if !ordered {
+		bulk.Unordered()
+	}
+
+	for i, op := range ops {
+		if op.Insert == nil && !op.Remove && op.Update != nil {
+			update, err := r.writeUpdate(op.Update)
+			if err != nil {
+				return nil, fmt.Errorf("BulkWrite operation at %v: %v", i, err)
+			}
+			if op.Upsert {
+				op.Update = r.restoreUpdate(op.Selector, update)
+			} else {
+				op.Selector, op.Update = r.notDeleted(op.Selector), update
+			}
+		}
+
+		switch {
+		case op.Insert != nil:
+			bulk.Insert(op.Insert)
+		case op.Remove && op.Multi:
+			bulk.RemoveAll(op.Selector)
+		case op.Remove:
+			bulk.Remove(op.Selector)
+		case op.Upsert:
+			bulk.Upsert(op.Selector, op.Update)
+		case op.Multi:
+			bulk.UpdateAll(op.Selector, op.Update)
+		case op.Update != nil:
+			bulk.Update(op.Selector, op.Update)
+		default:
+			return nil, fmt.Errorf("BulkWrite empty operation at %v", i)
+		}
+	}
+
+	result, err := bulk.Run()
+	RecordQuery("bulkWrite", r.Collection, nil, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.BulkWrite %v collection: %v", err, r.Collection))
+		return result, err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.BulkWrite took: %v collection: %v len(%v)", time.Since(conn.Time), r.Collection, len(ops)))
+	return result, nil
+}
+
+// Aggregate run pipeline and decode the output documents into results, a pointer to a slice.
+// Soft-deleted documents are not filtered, start the pipeline with a $match on NotDeleted
+func (r *Repository) Aggregate(pipeline interface{}, results interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := conn.Col.Pipe(pipeline).AllowDiskUse().All(results)
+	RecordQuery("aggregate", r.Collection, pipeline, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.Aggregate %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.Aggregate took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// AggregateOne run pipeline and decode the first output document into result
+func (r *Repository) AggregateOne(pipeline interface{}, result interface{}) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := conn.Col.Pipe(pipeline).One(result)
+	RecordQuery("aggregate", r.Collection, pipeline, conn.Time, err)
+	return err
+}
+
+func pageSort(req PageRequest) []string {
+	prefix := ""
+	if req.Desc {
+		prefix = "-"
+	}
+	if req.SortField == "_id" {
+		return []string{prefix + "_id"}
+	}
+
+	return []string{prefix + req.SortField, prefix + "_id"}
+}
+
+// pageSelector req.Selector restricted to the documents after the cursor
+func pageSelector(req PageRequest) (bson.M, error) {
+	selector := bson.M{}
+	for k, v := range req.Selector {
+		selector[k] = v
+	}
+	if req.Cursor == "" {
+		return selector, nil
+	}
+
+	cursor, err := decodePageCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	op := "$gt"
+	if req.Desc {
+		op = "$lt"
+	}
+
+	var after bson.M
+	if req.SortField == "_id" {
+		after = bson.M{"_id": bson.M{op: cursor.ID}}
+	} else {
+		after = bson.M{"$or": []bson.M{
+			{req.SortField: bson.M{op: cursor.Value}},
+			{req.SortField: cursor.Value, "_id": bson.M{op: cursor.ID}},
+		}}
+	}
+
+	if len(selector) == 0 {
+		return after, nil
+	}
+	return bson.M{"$and": []bson.M{selector, after}}, nil
+}
+
+// encodePageCursor cursor of the sort field and _id values of doc
+func encodePageCursor(doc interface{}, sortField string) (string, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	var m bson.M
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		return "", err
+	}
+
+	id, ok := m["_id"]
+	if !ok {
+		return "", fmt.Errorf("FindPage documents must include _id")
+	}
+	value, ok := lookupField(m, sortField)
+	if !ok {
+		return "", fmt.Errorf("FindPage documents must include the sort field %v", sortField)
+	}
+
+	data, err := bson.Marshal(pageCursor{Value: value, ID: id})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageCursor(cursor string) (pageCursor, error) {
+	var c pageCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, fmt.Errorf("invalid page cursor: %v", err)
+	}
+	if err := bson.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid page cursor: %v", err)
+	}
+
+	return c, nil
+}
+
+// lookupField value of a dotted field path in m
+func lookupField(m bson.M, field string) (interface{}, bool) {
+	var value interface{} = m
+	for _, key := range strings.Split(field, ".") {
+		doc, ok := value.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = doc[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
@@ -0,0 +1,291 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+var (
+	// VersionField document version incremented by UpdateVersioned, the soft delete helpers
+	// and the updates of a Versioned repository
+	VersionField = "version"
+
+	// DeletedAtField soft delete time of a document
+	DeletedAtField = "deleted_at"
+
+	// ErrVersionConflict the document was updated since the expected version was read
+	ErrVersionConflict = fmt.Errorf("document version conflict")
+)
+
+// NotDeleted selector of the documents not soft-deleted, e.g. for a $match stage. Matches
+// DeletedAtField missing or null, as written by structs with a nil *time.Time
+func NotDeleted() bson.M {
+	return bson.M{DeletedAtField: nil}
+}
+
+// UpdateVersioned apply update to the document with _id id when its VersionField is still
+// expectedVersion, and increment it. A document without VersionField is at version 0.
+// ErrVersionConflict when the version changed, mgo.ErrNotFound when the document is missing
+// or soft-deleted
+func (r *Repository) UpdateVersioned(id interface{}, expectedVersion int64, update bson.M) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	versioned, err := versionedUpdate(update)
+	if err != nil {
+		return err
+	}
+
+	selector := r.notDeleted(bson.M{"_id": id})
+	err = conn.Col.Update(versionSelector(selector, expectedVersion), versioned)
+	RecordQuery("updateVersioned", r.Collection, selector, conn.Time, err)
+	if err == mongodb.ErrNotFound {
+		// missing document or stale version
+		if n, cerr := conn.Col.Find(selector).Count(); cerr == nil && n > 0 {
+			return ErrVersionConflict
+		}
+		return err
+	}
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.UpdateVersioned %v collection: %v", err, r.Collection))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.UpdateVersioned took: %v collection: %v", time.Since(conn.Time), r.Collection))
+	return nil
+}
+
+// SoftDeleteByID set DeletedAtField of the document with _id id, mgo.ErrNotFound when it
+// is missing or already deleted
+func (r *Repository) SoftDeleteByID(id interface{}) error {
+	return r.setDeleted(bson.M{"_id": id, DeletedAtField: nil}, bson.M{
+		"$set": bson.M{DeletedAtField: time.Now()},
+		"$inc": bson.M{VersionField: 1},
+	})
+}
+
+// RestoreByID unset DeletedAtField of the soft-deleted document with _id id
+func (r *Repository) RestoreByID(id interface{}) error {
+	return r.setDeleted(bson.M{"_id": id, DeletedAtField: bson.M{"$ne": nil}}, bson.M{
+		"$unset": bson.M{DeletedAtField: ""},
+		"$inc":   bson.M{VersionField: 1},
+	})
+}
+
+// PurgeDeleted remove the documents soft-deleted before the given time, returns the number removed
+func (r *Repository) PurgeDeleted(before time.Time) (int, error) {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	selector := bson.M{DeletedAtField: bson.M{"$lt": before}}
+	info, err := conn.Col.RemoveAll(selector)
+	RecordQuery("purgeDeleted", r.Collection, selector, conn.Time, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error Repository.PurgeDeleted %v collection: %v", err, r.Collection))
+		return 0, err
+	}
+
+	utils.Info(fmt.Sprintf("Repository.PurgeDeleted took: %v collection: %v removed(%v)", time.Since(conn.Time), r.Collection, info.Removed))
+	return info.Removed, nil
+}
+
+func (r *Repository) setDeleted(selector, update bson.M) error {
+	conn := r.begin()
+	defer conn.Conn.Close()
+
+	err := conn.Col.Update(selector, update)
+	RecordQuery("softDelete", r.Collection, selector, conn.Time, err)
+	if err != nil && err != mongodb.ErrNotFound {
+		utils.Error(fmt.Sprintf("error Repository.SoftDelete %v collection: %v", err, r.Collection))
+	}
+
+	return err
+}
+
+// notDeleted selector restricted to the documents not soft-deleted when the repository uses
+// SoftDelete. A selector on DeletedAtField is kept, to find the deleted documents
+func (r *Repository) notDeleted(selector interface{}) interface{} {
+	if !r.SoftDelete {
+		return selector
+	}
+
+	switch s := selector.(type) {
+	case nil:
+		return NotDeleted()
+	case bson.M:
+		if _, ok := s[DeletedAtField]; ok {
+			return s
+		}
+		restricted := NotDeleted()
+		for k, v := range s {
+			restricted[k] = v
+		}
+		return restricted
+	}
+
+	return bson.M{"$and": []interface{}{selector, NotDeleted()}}
+}
+
+// restoreUpdate upsert update unsetting DeletedAtField when the repository uses SoftDelete,
+// the upsert selector matches the soft-deleted documents too so a match is restored instead
+// of inserted again. Replacement documents drop DeletedAtField by themselves, they and the
+// updates writing DeletedAtField are kept
+func (r *Repository) restoreUpdate(selector, update interface{}) interface{} {
+	if !r.SoftDelete {
+		return update
+	}
+	if s, ok := selector.(bson.M); ok {
+		if _, ok := s[DeletedAtField]; ok {
+			return update
+		}
+	}
+
+	var m bson.M
+	switch u := update.(type) {
+	case bson.M:
+		m = u
+	case map[string]interface{}:
+		m = bson.M(u)
+	case bson.D:
+		m = u.Map()
+	default:
+		return update
+	}
+
+	restored := bson.M{}
+	for k, v := range m {
+		if !strings.HasPrefix(k, "$") {
+			return update
+		}
+		restored[k] = v
+	}
+
+	unset, err := operatorDoc("$unset", restored["$unset"])
+	if err != nil {
+		return update
+	}
+	for _, op := range []string{"$set", "$setOnInsert", "$currentDate"} {
+		if doc, err := operatorDoc(op, restored[op]); err != nil {
+			return update
+		} else if _, ok := doc[DeletedAtField]; ok {
+			return update
+		}
+	}
+
+	fields := bson.M{DeletedAtField: ""}
+	for k, v := range unset {
+		fields[k] = v
+	}
+	restored["$unset"] = fields
+
+	return restored
+}
+
+// versionSelector selector matching expectedVersion, version 0 matching the documents without VersionField
+func versionSelector(selector interface{}, expectedVersion int64) bson.M {
+	if s, ok := selector.(bson.M); ok && expectedVersion != 0 {
+		versioned := bson.M{VersionField: expectedVersion}
+		for k, v := range s {
+			versioned[k] = v
+		}
+		return versioned
+	}
+
+	match := bson.M{VersionField: expectedVersion}
+	if expectedVersion == 0 {
+		match = bson.M{"$or": []bson.M{{VersionField: 0}, {VersionField: bson.M{"$exists": false}}}}
+	}
+
+	return bson.M{"$and": []interface{}{selector, match}}
+}
+
+// writeUpdate update of UpdateByID, Upsert and BulkWrite, with VersionField incremented
+// when the repository is Versioned. Replacement structs are applied as a $set of their fields
+func (r *Repository) writeUpdate(update interface{}) (interface{}, error) {
+	if !r.Versioned {
+		return update, nil
+	}
+
+	switch u := update.(type) {
+	case bson.M:
+		return versionedUpdate(u)
+	case map[string]interface{}:
+		return versionedUpdate(bson.M(u))
+	case bson.D:
+		return versionedUpdate(u.Map())
+	}
+
+	raw, err := bson.Marshal(update)
+	if err != nil {
+		return nil, fmt.Errorf("versioned repository update must be a document: %v", err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("versioned repository update must be a document: %v", err)
+	}
+
+	return versionedUpdate(m)
+}
+
+// versionedUpdate update with VersionField incremented, a document without operators is set.
+// VersionField is only set by the increment. $set and $inc may be bson.M, bson.D or maps
+func versionedUpdate(update bson.M) (bson.M, error) {
+	versioned := bson.M{}
+	fields := bson.M{}
+	for k, v := range update {
+		if strings.HasPrefix(k, "$") {
+			versioned[k] = v
+		} else if k != VersionField {
+			fields[k] = v
+		}
+	}
+
+	set, err := operatorDoc("$set", versioned["$set"])
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range set {
+		if k != VersionField {
+			fields[k] = v
+		}
+	}
+	delete(versioned, "$set")
+	if len(fields) != 0 {
+		versioned["$set"] = fields
+	}
+
+	current, err := operatorDoc("$inc", versioned["$inc"])
+	if err != nil {
+		return nil, err
+	}
+	inc := bson.M{VersionField: 1}
+	for k, v := range current {
+		if k != VersionField {
+			inc[k] = v
+		}
+	}
+	versioned["$inc"] = inc
+
+	return versioned, nil
+}
+
+// operatorDoc fields of the update operator op, nil when absent
+func operatorDoc(op string, doc interface{}) (bson.M, error) {
+	switch d := doc.(type) {
+	case nil:
+		return nil, nil
+	case bson.M:
+		return d, nil
+	case map[string]interface{}:
+		return bson.M(d), nil
+	case bson.D:
+		return d.Map(), nil
+	}
+
+	return nil, fmt.Errorf("versioned repository update %v must be a document, got %T", op, doc)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestVersionedUpdate(t *testing.T) {
+	want := bson.M{
+		"$set": bson.M{"name": "a", "age": 2},
+		"$inc": bson.M{"hits": 1, VersionField: 1},
+	}
+	for _, update := range []bson.M{
+		{"name": "a", "$set": bson.M{"age": 2}, "$inc": bson.M{"hits": 1, VersionField: 5}},
+		{"name": "a", "$set": map[string]interface{}{"age": 2}, "$inc": map[string]interface{}{"hits": 1, VersionField: 5}},
+		{"name": "a", "$set": bson.D{{Name: "age", Value: 2}}, "$inc": bson.D{{Name: "hits", Value: 1}, {Name: VersionField, Value: 5}}},
+	} {
+		got, err := versionedUpdate(update)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("versionedUpdate(%v)=%v err=%v, want %v", update, got, err, want)
+		}
+	}
+
+	if _, err := versionedUpdate(bson.M{"$set": []string{"age"}}); err == nil {
+		t.Error("a $set that is not a document must be rejected")
+	}
+	if _, err := versionedUpdate(bson.M{"$inc": "hits"}); err == nil {
+		t.Error("an $inc that is not a document must be rejected")
+	}
+
+	if got := versionSelector(bson.M{"_id": 1}, 3); !reflect.DeepEqual(got, bson.M{"_id": 1, VersionField: int64(3)}) {
+		t.Errorf("versionSelector=%v", got)
+	}
+	if got := versionSelector(bson.M{"_id": 1}, 0); got["$and"] == nil {
+		t.Errorf("version 0 must match documents without version %v", got)
+	}
+}
+
+func TestNotDeleted(t *testing.T) {
+	repo := &Repository{Collection: "items"}
+	if got := repo.notDeleted(bson.M{"a": 1}); !reflect.DeepEqual(got, bson.M{"a": 1}) {
+		t.Errorf("without SoftDelete the selector is kept %v", got)
+	}
+
+	repo = repo.WithOptions(SessionOptions{SyncTimeout: time.Second})
+	repo.SoftDelete = true
+	if got := repo.notDeleted(bson.M{"a": 1}); !reflect.DeepEqual(got, bson.M{"a": 1, DeletedAtField: nil}) {
+		t.Errorf("notDeleted=%v", got)
+	}
+	if got := repo.notDeleted(nil); !reflect.DeepEqual(got, NotDeleted()) {
+		t.Errorf("notDeleted(nil)=%v", got)
+	}
+
+	deleted := bson.M{DeletedAtField: bson.M{"$ne": nil}}
+	if got := repo.notDeleted(deleted); !reflect.DeepEqual(got, deleted) {
+		t.Errorf("a selector on %v must be kept %v", DeletedAtField, got)
+	}
+	if got := repo.WithOptions(SessionOptions{}); !got.SoftDelete {
+		t.Error("WithOptions must keep SoftDelete")
+	}
+}
+
+func TestWriteUpdate(t *testing.T) {
+	repo := &Repository{Collection: "items"}
+	update := bson.M{"$set": bson.M{"name": "a"}}
+	if got, err := repo.writeUpdate(update); err != nil || !reflect.DeepEqual(got, update) {
+		t.Errorf("without Versioned the update is kept %v err=%v", got, err)
+	}
+
+	repo.Versioned = true
+	got, err := repo.writeUpdate(bson.M{"$set": bson.M{"name": "a", VersionField: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"$set": bson.M{"name": "a"}, "$inc": bson.M{VersionField: 1}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("writeUpdate=%v, want %v", got, want)
+	}
+
+	type item struct {
+		Name    string `bson:"name"`
+		Version int64  `bson:"version"`
+	}
+	got, err = repo.writeUpdate(item{Name: "b", Version: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"$set": bson.M{"name": "b"}, "$inc": bson.M{VersionField: 1}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("replacement writeUpdate=%v, want %v", got, want)
+	}
+
+	got, err = repo.writeUpdate(bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "c"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"$set": bson.M{"name": "c"}, "$inc": bson.M{VersionField: 1}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("bson.D writeUpdate=%v, want %v", got, want)
+	}
+
+	if _, err := repo.writeUpdate("name"); err == nil {
+		t.Error("a non document update must be rejected")
+	}
+}
+
+func TestRestoreUpdate(t *testing.T) {
+	repo := &Repository{Collection: "items"}
+	update := bson.M{"$set": bson.M{"name": "a"}}
+	if got := repo.restoreUpdate(bson.M{"_id": 1}, update); !reflect.DeepEqual(got, update) {
+		t.Errorf("without SoftDelete the update is kept %v", got)
+	}
+
+	repo.SoftDelete = true
+	want := bson.M{"$set": bson.M{"name": "a"}, "$unset": bson.M{DeletedAtField: "", "tmp": ""}}
+	for _, update := range []interface{}{
+		bson.M{"$set": bson.M{"name": "a"}, "$unset": bson.M{"tmp": ""}},
+		bson.D{{Name: "$set", Value: bson.M{"name": "a"}}, {Name: "$unset", Value: bson.D{{Name: "tmp", Value: ""}}}},
+	} {
+		if got := repo.restoreUpdate(bson.M{"_id": 1}, update); !reflect.DeepEqual(got, want) {
+			t.Errorf("restoreUpdate(%v)=%v, want %v", update, got, want)
+		}
+	}
+
+	// kept: replacement, deleted_at written by the update or selected by the caller
+	for _, c := range []struct {
+		selector interface{}
+		update   interface{}
+	}{
+		{bson.M{"_id": 1}, bson.M{"name": "a"}},
+		{bson.M{"_id": 1}, bson.M{"$set": bson.M{DeletedAtField: nil}}},
+		{bson.M{DeletedAtField: bson.M{"$ne": nil}}, bson.M{"$set": bson.M{"name": "a"}}},
+	} {
+		if got := repo.restoreUpdate(c.selector, c.update); !reflect.DeepEqual(got, c.update) {
+			t.Errorf("restoreUpdate(%v, %v)=%v, want the update kept", c.selector, c.update, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type pageItem struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Created time.Time     `bson:"created"`
+	Meta    struct {
+		Rank int `bson:"rank"`
+	} `bson:"meta"`
+}
+
+func TestPageCursor(t *testing.T) {
+	item := pageItem{ID: bson.NewObjectId(), Created: time.Unix(1500000000, 0).UTC()}
+	item.Meta.Rank = 7
+
+	cursor, err := encodePageCursor(item, "meta.rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodePageCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != item.ID || decoded.Value != 7 {
+		t.Errorf("decoded cursor %+v", decoded)
+	}
+
+	if _, err := encodePageCursor(item, "missing"); err == nil {
+		t.Error("expected an error for a missing sort field")
+	}
+	if _, err := decodePageCursor("%%%"); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
+
+func TestPageSelector(t *testing.T) {
+	id := bson.NewObjectId()
+	cursor, _ := encodePageCursor(bson.M{"_id": id, "rank": 3}, "rank")
+
+	selector, err := pageSelector(PageRequest{Selector: bson.M{"owner": "u1"}, SortField: "rank", Desc: true, Cursor: cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$and": []bson.M{
+		{"owner": "u1"},
+		{"$or": []bson.M{
+			{"rank": bson.M{"$lt": 3}},
+			{"rank": 3, "_id": bson.M{"$lt": id}},
+		}},
+	}}
+	if !reflect.DeepEqual(selector, want) {
+		t.Errorf("selector=%v\nwant=%v", selector, want)
+	}
+
+	selector, _ = pageSelector(PageRequest{SortField: "_id", Cursor: cursor})
+	if !reflect.DeepEqual(selector, bson.M{"_id": bson.M{"$gt": id}}) {
+		t.Errorf("_id selector=%v", selector)
+	}
+
+	if sort := pageSort(PageRequest{SortField: "rank", Desc: true}); !reflect.DeepEqual(sort, []string{"-rank", "-_id"}) {
+		t.Errorf("sort=%v", sort)
+	}
+}
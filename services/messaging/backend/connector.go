@@ -3,6 +3,8 @@ package backend
 import (
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/b-eee/amagi/services/configctl"
 
@@ -29,8 +31,10 @@ type (
 
 	// MSGBackendSubscReq messaging backend subscribe request
 	MSGBackendSubscReq struct {
-		Topic   string
-		Channel string
+		Topic       string
+		Channel     string
+		Handler     MessageHandler
+		Concurrency int
 	}
 
 	// MSGBackendPubReq messaging backend subscribe request
@@ -38,21 +42,23 @@ type (
 		Topic string
 		Body  []byte
 	}
+)
 
-	connectionObjLauncher map[string]func(MSGBackendConfig) error
+var (
+	currentBackendMu sync.RWMutex
+	currentBackend   Backend
 )
 
 // SetAndInitBackend set and initialize backend
 func SetAndInitBackend() MSGBackendConfig {
 	msgConfig := MSGBackendConfig{}
 
-	switch os.Getenv(MessagingBackendENV) {
-	case "nsq":
-		msgConfig.Backend = "nsq"
-		msgConfig.Env = configctl.GetDBCfgStngWEnvName("nsq", os.Getenv("ENV"))
-	case "nats":
-		msgConfig.Backend = "nats"
-		msgConfig.Env = configctl.GetDBCfgStngWEnvName("nats", os.Getenv("ENV"))
+	name := os.Getenv(MessagingBackendENV)
+	if driver, ok := GetDriver(name); ok {
+		msgConfig.Backend = name
+		if driver.RemoteConfig {
+			msgConfig.Env = configctl.GetDBCfgStngWEnvName(name, os.Getenv("ENV"))
+		}
 	}
 
 	return SetMSGBackendConfig(msgConfig)
@@ -70,57 +76,131 @@ func GetMSGBackendConfig() MSGBackendConfig {
 	return CurrentMSGBackendConfig
 }
 
-// ConnectToMsgBackend connect to msg backend by settings config
+// SetBackend set the current backend instance used by the package level functions
+func SetBackend(b Backend) {
+	currentBackendMu.Lock()
+	defer currentBackendMu.Unlock()
+
+	currentBackend = b
+}
+
+// GetBackend get the current backend instance, nil if not connected
+func GetBackend() Backend {
+	currentBackendMu.RLock()
+	defer currentBackendMu.RUnlock()
+
+	return currentBackend
+}
+
+// ConnectToMsgBackend connect to msg backend by settings config and set it as current backend
 func ConnectToMsgBackend(confg MSGBackendConfig) error {
 	if (MSGBackendConfig{}) == confg {
 		return fmt.Errorf("MSGBackendConfig not set")
 	}
 
-	connectionObj := connectionObjLauncher{
-		"nsq":  StartNSQ,
-		"nats": StartNATS,
+	utils.Info(fmt.Sprintf("connecting to %v.. %v", confg.Backend, confg.Env.Host))
+
+	b, err := Connect(confg)
+	if err != nil {
+		return err
 	}
 
-	utils.Info(fmt.Sprintf("connecting to %v.. %v", confg.Backend, confg.Env.Host))
+	SetBackend(b)
+	return nil
+}
+
+// SubscribeToBackend subscribe to the current messaging backend
+func SubscribeToBackend(confg MSGBackendConfig, req MSGBackendSubscReq) (Subscription, error) {
+	b, err := currentBackendFor(confg)
+	if err != nil {
+		return nil, err
+	}
 
-	return connectionObj[confg.Backend](confg)
+	return b.Subscribe(req)
 }
 
-// SubscribeToBackend subscribe to messaging backend
-func SubscribeToBackend(confg MSGBackendConfig, req MSGBackendSubscReq) error {
-	switch confg.Backend {
-	case "nsq":
-		nsqReq := NSQConsumerReq{
-			Topic:   req.Topic,
-			Channel: req.Channel,
-		}
+// PublishToBackend publish to the current messaging backend
+func PublishToBackend(confg MSGBackendConfig, req MSGBackendPubReq) error {
+	b, err := currentBackendFor(confg)
+	if err != nil {
+		return err
+	}
 
-		if err := NSQCreateConsumer(confg, nsqReq); err != nil {
-			return err
-		}
-	case "nats":
+	return b.Publish(req)
+}
+
+// MultiPublishToBackend publish a batch of bodies to the current messaging backend,
+// one by one when the backend has no batch publish
+func MultiPublishToBackend(confg MSGBackendConfig, topic string, bodies [][]byte) error {
+	b, err := currentBackendFor(confg)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return MultiPublish(b, topic, bodies)
 }
 
-// PublishToBackend publish to messaging backend
-func PublishToBackend(confg MSGBackendConfig, req MSGBackendPubReq) error {
-	nsqReq := NSQPubReq{
-		Topic: req.Topic,
-		Body:  req.Body,
+// MultiPublish publish a batch of bodies with b, one by one when b has no batch publish
+func MultiPublish(b Backend, topic string, bodies [][]byte) error {
+	if mp, ok := b.(MultiPublisher); ok {
+		return mp.MultiPublish(topic, bodies)
 	}
 
-	switch confg.Backend {
-	case "nsq":
-		if err := NSQPublish(nsqReq); err != nil {
-			return err
-		}
-	case "nats":
-		if err := NATSPublish(nsqReq); err != nil {
+	for _, body := range bodies {
+		if err := b.Publish(MSGBackendPubReq{Topic: topic, Body: body}); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// RequestToBackend send a request with the current messaging backend and wait for the reply
+func RequestToBackend(confg MSGBackendConfig, topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	b, err := currentBackendFor(confg)
+	if err != nil {
+		return nil, err
+	}
+
+	return Request(b, topic, body, timeout)
+}
+
+// RespondOnBackend answer the requests sent to topic with the current messaging backend
+func RespondOnBackend(confg MSGBackendConfig, topic, channel string, handler ReplyHandler) (Subscription, error) {
+	b, err := currentBackendFor(confg)
+	if err != nil {
+		return nil, err
+	}
+
+	return Respond(b, topic, channel, handler)
+}
+
+// BackendHealth check the current messaging backend connection
+func BackendHealth() error {
+	b := GetBackend()
+	if b == nil {
+		return fmt.Errorf("messaging backend is not connected")
+	}
+
+	return b.Health()
+}
+
+// CloseBackend close the current messaging backend
+func CloseBackend() error {
+	b := GetBackend()
+	if b == nil {
+		return nil
+	}
+
+	SetBackend(nil)
+	return b.Close()
+}
+
+func currentBackendFor(confg MSGBackendConfig) (Backend, error) {
+	b := GetBackend()
+	if b == nil {
+		return nil, fmt.Errorf("messaging backend %v is not connected", confg.Backend)
+	}
+
+	return b, nil
+}
@@ -13,3 +13,47 @@ func TestSetAndInitBackend(t *testing.T) {
 		t.Errorf("MSGBackendConfig not set")
 	}
 }
+
+type testBackend struct {
+	connected MSGBackendConfig
+	published []MSGBackendPubReq
+}
+
+func (b *testBackend) Connect(conf MSGBackendConfig) error { b.connected = conf; return nil }
+func (b *testBackend) Publish(req MSGBackendPubReq) error {
+	b.published = append(b.published, req)
+	return nil
+}
+func (b *testBackend) Subscribe(MSGBackendSubscReq) (Subscription, error) { return nil, nil }
+func (b *testBackend) Close() error                                       { return nil }
+func (b *testBackend) Health() error                                      { return nil }
+
+func TestRegisterBackend(t *testing.T) {
+	Register("testing", BackendDriver{New: func() Backend { return &testBackend{} }})
+
+	if _, err := NewBackend("unknown"); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+
+	// each Connect creates an independent instance
+	conf := MSGBackendConfig{Backend: "testing"}
+	first, err := Connect(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := Connect(conf)
+	if first == second {
+		t.Error("Connect must create a new backend instance")
+	}
+
+	if err := ConnectToMsgBackend(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer SetBackend(nil)
+	if err := PublishToBackend(conf, MSGBackendPubReq{Topic: "test", Body: []byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if published := GetBackend().(*testBackend).published; len(published) != 1 || published[0].Topic != "test" {
+		t.Errorf("published=%v, want one message on test", published)
+	}
+}
@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+)
+
+type (
+	// RedeliveryPolicy requeue a failing message with backoff up to MaxAttempts, then
+	// publish it to the dead-letter topic of its topic. With nsq, MaxAttempts must not be
+	// above the max_attempts of the consumer config (5), nsq drops the message after it
+	RedeliveryPolicy struct {
+		MaxAttempts int
+		MinBackoff  time.Duration
+		MaxBackoff  time.Duration
+	}
+
+	// DeadLetter message published to the dead-letter topic once out of attempts
+	DeadLetter struct {
+		ID        string    `json:"id"`
+		Topic     string    `json:"topic"`
+		Channel   string    `json:"channel"`
+		Body      []byte    `json:"body"`
+		Attempts  uint16    `json:"attempts"`
+		Error     string    `json:"error"`
+		Timestamp time.Time `json:"timestamp"`
+		FailedAt  time.Time `json:"failed_at"`
+	}
+
+	// PermanentError handler error not worth a retry, dead-lettered right away by WithRedelivery
+	PermanentError struct {
+		Err error
+	}
+
+	// Redeliverer backend telling whether failed messages are redelivered by the broker,
+	// backends not implementing it are expected to redeliver
+	Redeliverer interface {
+		Redelivers() bool
+	}
+)
+
+var (
+	// DefaultRedeliveryPolicy redelivery policy of a zero RedeliveryPolicy
+	DefaultRedeliveryPolicy = RedeliveryPolicy{
+		MaxAttempts: 5,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+	}
+
+	// DeadLetterSuffix suffix of the dead-letter topic of a topic
+	DeadLetterSuffix = ".dead"
+
+	// DeadLetterReplayChannel channel consuming the dead-letter topics on replay. nsq keeps the
+	// messages of a topic without channel for its first one and redis creates the groups of
+	// dead-letter topics from the start of the stream, keep replay the only consumer of
+	// dead-letter topics so it receives the messages dead-lettered before its first run
+	DeadLetterReplayChannel = "replay"
+
+	// ErrReplayUnsupported the backend does not keep the messages published without subscriber
+	ErrReplayUnsupported = fmt.Errorf("dead letter replay requires a durable backend (nsq, redis)")
+
+	// ErrRedeliveryUnsupported the backend delivers at most once and can't requeue a failed message
+	ErrRedeliveryUnsupported = fmt.Errorf("redelivery requires a backend with acks (nsq, redis, memory)")
+)
+
+// Redelivers whether b redelivers the failed messages, core nats delivers at most once
+func Redelivers(b Backend) bool {
+	if r, ok := b.(Redeliverer); ok {
+		return r.Redelivers()
+	}
+
+	return true
+}
+
+// DeadLetterTopic dead-letter topic of topic
+func DeadLetterTopic(topic string) string {
+	return topic + DeadLetterSuffix
+}
+
+// WithRedelivery wrap handler to requeue its failures with the policy backoff and route
+// the messages out of attempts to the dead-letter topic. Backends not redelivering
+// failed messages (core nats) retry the handler from a goroutine instead, so the
+// delivery of the other messages is not blocked by the backoff
+func WithRedelivery(b Backend, policy RedeliveryPolicy, handler MessageHandler) MessageHandler {
+	policy = policy.withDefaults()
+
+	redelivers := Redelivers(b)
+
+	return func(msg *Message) error {
+		err := handler(msg)
+		if err == nil {
+			return nil
+		}
+
+		if !redelivers && int(msg.Attempts) < policy.MaxAttempts && !isPermanent(err) {
+			retried := *msg
+			go retryInPlace(b, policy, handler, &retried, err)
+			return nil
+		}
+
+		if int(msg.Attempts) < policy.MaxAttempts && !isPermanent(err) {
+			if requeueDelay(err) >= 0 {
+				return err
+			}
+			return RequeueAfter(policy.Backoff(int(msg.Attempts)), err)
+		}
+
+		// the message is requeued if it can't be dead-lettered
+		if dlErr := publishDeadLetter(b, msg, err); dlErr != nil {
+			utils.Error(fmt.Sprintf("error dead letter topic=%v id=%v err=%v", msg.Topic, msg.ID, dlErr))
+			return err
+		}
+
+		return nil
+	}
+}
+
+// retryInPlace retry the handler of a failed message with the policy backoff, dead-lettering
+// it once out of attempts
+func retryInPlace(b Backend, policy RedeliveryPolicy, handler MessageHandler, msg *Message, err error) {
+	for err != nil && !isPermanent(err) && int(msg.Attempts) < policy.MaxAttempts {
+		time.Sleep(policy.Backoff(int(msg.Attempts)))
+		msg.Attempts++
+		err = handler(msg)
+	}
+	if err == nil {
+		return
+	}
+
+	if dlErr := publishDeadLetter(b, msg, err); dlErr != nil {
+		utils.Error(fmt.Sprintf("error dead letter topic=%v id=%v err=%v, message dropped", msg.Topic, msg.ID, dlErr))
+	}
+}
+
+// Permanent mark a handler error as permanent, the message is not retried
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// Backoff delay before redelivering a message failed attempts times
+func (policy RedeliveryPolicy) Backoff(attempts int) time.Duration {
+	d := policy.MinBackoff
+	for i := 1; i < attempts && d < policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > policy.MaxBackoff {
+		d = policy.MaxBackoff
+	}
+
+	return d
+}
+
+func (policy RedeliveryPolicy) withDefaults() RedeliveryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRedeliveryPolicy.MaxAttempts
+	}
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = DefaultRedeliveryPolicy.MinBackoff
+	}
+	if policy.MaxBackoff < policy.MinBackoff {
+		policy.MaxBackoff = DefaultRedeliveryPolicy.MaxBackoff
+		if policy.MaxBackoff < policy.MinBackoff {
+			policy.MaxBackoff = policy.MinBackoff
+		}
+	}
+
+	return policy
+}
+
+func publishDeadLetter(b Backend, msg *Message, cause error) error {
+	data, err := json.Marshal(DeadLetter{
+		ID:        msg.ID,
+		Topic:     msg.Topic,
+		Channel:   msg.Channel,
+		Body:      msg.Body,
+		Attempts:  msg.Attempts,
+		Error:     cause.Error(),
+		Timestamp: msg.Timestamp,
+		FailedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	utils.Error(fmt.Sprintf("dead letter topic=%v chan=%v attempts=%v err=%v", msg.Topic, msg.Channel, msg.Attempts, cause))
+	return b.Publish(MSGBackendPubReq{Topic: DeadLetterTopic(msg.Topic), Body: data})
+}
+
+// ReplayDeadLetters republish up to max dead letters of topic to their original topic,
+// stopping once no dead letter arrived for idle. max 0 replays all of them.
+// Core nats drops the dead letters published without subscriber, ErrReplayUnsupported
+func ReplayDeadLetters(b Backend, topic string, max int, idle time.Duration) (int, error) {
+	if !Redelivers(b) {
+		return 0, ErrReplayUnsupported
+	}
+
+	var (
+		mu       sync.Mutex
+		replayed int
+		done     = make(chan struct{})
+		once     sync.Once
+		activity = make(chan struct{}, 1)
+	)
+
+	sub, err := b.Subscribe(MSGBackendSubscReq{
+		Topic:   DeadLetterTopic(topic),
+		Channel: DeadLetterReplayChannel,
+		Handler: func(msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			// over the limit, left for a later replay
+			if max > 0 && replayed >= max {
+				return RequeueAfter(idle, fmt.Errorf("replay limit reached"))
+			}
+
+			var dl DeadLetter
+			if err := json.Unmarshal(msg.Body, &dl); err != nil {
+				utils.Error(fmt.Sprintf("error ReplayDeadLetters invalid dead letter topic=%v err=%v", msg.Topic, err))
+				return nil
+			}
+			if err := b.Publish(MSGBackendPubReq{Topic: dl.Topic, Body: dl.Body}); err != nil {
+				return err
+			}
+
+			replayed++
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+			if max > 0 && replayed >= max {
+				once.Do(func() { close(done) })
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case <-timer.C:
+			waiting = false
+		}
+	}
+	sub.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	utils.Info(fmt.Sprintf("ReplayDeadLetters topic=%v replayed=%v", topic, replayed))
+	return replayed, nil
+}
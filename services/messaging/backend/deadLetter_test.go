@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// atMostOnceBackend memory backend reporting no redelivery, like core nats
+type atMostOnceBackend struct {
+	*MemoryBackend
+}
+
+func (atMostOnceBackend) Redelivers() bool { return false }
+
+func TestRedeliveryDeadLetter(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	var failing int32 = 1
+	var attempts []uint16
+	ok := make(chan string, 1)
+	policy := RedeliveryPolicy{MaxAttempts: 3, MinBackoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	b.Subscribe(MSGBackendSubscReq{Topic: "jobs", Channel: "workers", Handler: WithRedelivery(b, policy, func(msg *Message) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			attempts = append(attempts, msg.Attempts)
+			return fmt.Errorf("boom")
+		}
+		ok <- string(msg.Body)
+		return nil
+	})})
+	b.Publish(MSGBackendPubReq{Topic: "jobs", Body: []byte("job")})
+
+	// kept on the dead-letter topic until the first replay
+	deadline := time.Now().Add(time.Second)
+	for b.Depth(DeadLetterTopic("jobs"), DeadLetterReplayChannel) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not dead-lettered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("attempts=%v, want [1 2 3]", attempts)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	n, err := ReplayDeadLetters(b, "jobs", 0, 50*time.Millisecond)
+	if err != nil || n != 1 {
+		t.Fatalf("replayed=%v err=%v, want 1", n, err)
+	}
+	select {
+	case body := <-ok:
+		if body != "job" {
+			t.Errorf("replayed body %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replayed message not received")
+	}
+}
+
+func TestPublishDeadLetter(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	dead := make(chan *Message, 1)
+	b.Subscribe(MSGBackendSubscReq{Topic: "jobs.dead", Channel: "test", Handler: func(msg *Message) error {
+		dead <- msg
+		return nil
+	}})
+
+	msg := &Message{ID: "1", Topic: "jobs", Channel: "workers", Body: []byte("job"), Attempts: 3}
+	if err := publishDeadLetter(b, msg, fmt.Errorf("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-dead:
+		var dl DeadLetter
+		if err := json.Unmarshal(msg.Body, &dl); err != nil {
+			t.Fatal(err)
+		}
+		if dl.Topic != "jobs" || dl.Channel != "workers" || dl.Attempts != 3 || dl.Error != "boom" || string(dl.Body) != "job" || dl.FailedAt.IsZero() {
+			t.Errorf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead letter not published")
+	}
+}
+
+func TestRedeliveryInPlace(t *testing.T) {
+	b := atMostOnceBackend{NewMemoryBackend()}
+	defer b.Close()
+
+	var calls int32
+	handler := WithRedelivery(b, RedeliveryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}, func(msg *Message) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return fmt.Errorf("boom")
+		}
+		return nil
+	})
+
+	// the callback returns without waiting for the retries
+	if err := handler(&Message{Topic: "jobs", Attempts: 1}); err != nil {
+		t.Errorf("expected the retries to run in the background, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("calls=%v, want 3", atomic.LoadInt32(&calls))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRedeliveryInPlaceDeadLetter(t *testing.T) {
+	b := atMostOnceBackend{NewMemoryBackend()}
+	defer b.Close()
+
+	dead := make(chan *Message, 1)
+	b.Subscribe(MSGBackendSubscReq{Topic: "jobs.dead", Channel: "test", Handler: func(msg *Message) error {
+		dead <- msg
+		return nil
+	}})
+
+	handler := WithRedelivery(b, RedeliveryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond}, func(msg *Message) error {
+		return fmt.Errorf("boom")
+	})
+	if err := handler(&Message{Topic: "jobs", Body: []byte("job"), Attempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-dead:
+		var dl DeadLetter
+		json.Unmarshal(msg.Body, &dl)
+		if dl.Attempts != 2 || string(dl.Body) != "job" {
+			t.Errorf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead letter not published")
+	}
+}
+
+func TestReplayUnsupported(t *testing.T) {
+	b := atMostOnceBackend{NewMemoryBackend()}
+	defer b.Close()
+
+	if _, err := ReplayDeadLetters(b, "jobs", 0, time.Millisecond); err != ErrReplayUnsupported {
+		t.Errorf("err=%v, want ErrReplayUnsupported", err)
+	}
+}
+
+func TestRedeliveryBackoff(t *testing.T) {
+	policy := RedeliveryPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := policy.Backoff(attempts); got != want {
+			t.Errorf("Backoff(%v)=%v, want %v", attempts, got, want)
+		}
+	}
+}
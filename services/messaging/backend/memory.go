@@ -0,0 +1,322 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// MemoryBackend in-process messaging backend for tests and local development,
+	// select it with MESSAGING_BACKEND=memory. Follows the nsq semantics: every channel
+	// of a topic gets a copy of each message and the consumers of a channel share them.
+	// Messages published before a topic has any channel are kept until the first one subscribes
+	MemoryBackend struct {
+		mu     sync.Mutex
+		topics map[string]*memoryTopic
+		subs   map[*memorySubscription]bool
+		rpc    *rpcEmulator
+		closed bool
+	}
+
+	memoryTopic struct {
+		channels map[string]*memoryChannel
+		pending  []*Message
+	}
+
+	// memoryChannel unbounded message queue shared by the consumers of a channel
+	memoryChannel struct {
+		mu        sync.Mutex
+		messages  []*Message
+		ready     chan struct{}
+		ephemeral bool
+		consumers int
+	}
+
+	memorySubscription struct {
+		backend *MemoryBackend
+		topic   string
+		name    string
+		channel *memoryChannel
+		quit    chan struct{}
+		wg      sync.WaitGroup
+		once    sync.Once
+	}
+)
+
+var (
+	// MemoryRequeueDelay requeue delay of the memory backend when the handler does not set one
+	MemoryRequeueDelay = 100 * time.Millisecond
+
+	memoryMessageID    uint64
+	memoryEphemeralSeq uint64
+)
+
+func init() {
+	Register("memory", BackendDriver{
+		New: func() Backend { return NewMemoryBackend() },
+	})
+}
+
+// NewMemoryBackend create an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{
+		topics: map[string]*memoryTopic{},
+		subs:   map[*memorySubscription]bool{},
+	}
+	b.rpc = newRPCEmulator(b, rpcReplyTopic(), "")
+
+	return b
+}
+
+// Connect nothing to connect for the memory backend
+func (b *MemoryBackend) Connect(conf MSGBackendConfig) error {
+	return nil
+}
+
+// Publish copy the message to every channel of the topic
+func (b *MemoryBackend) Publish(req MSGBackendPubReq) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("memory backend is closed")
+	}
+
+	msg := &Message{
+		ID:        strconv.FormatUint(atomic.AddUint64(&memoryMessageID, 1), 10),
+		Topic:     req.Topic,
+		Body:      req.Body,
+		Timestamp: time.Now(),
+	}
+
+	topic := b.topic(req.Topic)
+	if len(topic.channels) == 0 {
+		topic.pending = append(topic.pending, msg)
+		return nil
+	}
+	for name, ch := range topic.channels {
+		ch.push(copyMessage(msg, name))
+	}
+
+	return nil
+}
+
+// Subscribe consume the topic on the channel, an empty channel receives its own copy of every message
+func (b *MemoryBackend) Subscribe(req MSGBackendSubscReq) (Subscription, error) {
+	if req.Handler == nil {
+		return nil, fmt.Errorf("memory subscribe handler is required topic=%v", req.Topic)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, fmt.Errorf("memory backend is closed")
+	}
+
+	name := req.Channel
+	ephemeral := name == ""
+	if ephemeral {
+		name = fmt.Sprintf("ephemeral_%v", atomic.AddUint64(&memoryEphemeralSeq, 1))
+	}
+
+	topic := b.topic(req.Topic)
+	ch, ok := topic.channels[name]
+	if !ok {
+		ch = &memoryChannel{ready: make(chan struct{}, 1), ephemeral: ephemeral}
+		// the first channel of a topic receives the messages published before
+		if len(topic.channels) == 0 {
+			for _, msg := range topic.pending {
+				ch.push(copyMessage(msg, name))
+			}
+			topic.pending = nil
+		}
+		topic.channels[name] = ch
+	}
+	ch.consumers++
+
+	sub := &memorySubscription{
+		backend: b,
+		topic:   req.Topic,
+		name:    name,
+		channel: ch,
+		quit:    make(chan struct{}),
+	}
+	b.subs[sub] = true
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		sub.wg.Add(1)
+		go sub.consume(req.Handler)
+	}
+
+	return sub, nil
+}
+
+// Request publish a request and wait for its reply
+func (b *MemoryBackend) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	return b.rpc.request(topic, body, timeout)
+}
+
+// Respond answer the requests published to topic on channel
+func (b *MemoryBackend) Respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	return b.rpc.respond(topic, channel, handler)
+}
+
+// Close close all subscriptions and reject new messages
+func (b *MemoryBackend) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	var subs []*memorySubscription
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+
+	return nil
+}
+
+// Health always healthy until closed
+func (b *MemoryBackend) Health() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("memory backend is closed")
+	}
+
+	return nil
+}
+
+// Depth number of messages waiting in a channel of a topic, for tests
+func (b *MemoryBackend) Depth(topicName, channelName string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topic, ok := b.topics[topicName]
+	if !ok {
+		return 0
+	}
+	ch, ok := topic.channels[channelName]
+	if !ok {
+		return len(topic.pending)
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.messages)
+}
+
+// topic get or create a topic, b.mu must be held
+func (b *MemoryBackend) topic(name string) *memoryTopic {
+	topic, ok := b.topics[name]
+	if !ok {
+		topic = &memoryTopic{channels: map[string]*memoryChannel{}}
+		b.topics[name] = topic
+	}
+
+	return topic
+}
+
+func (sub *memorySubscription) consume(handler MessageHandler) {
+	defer sub.wg.Done()
+
+	for {
+		msg, ok := sub.channel.pop(sub.quit)
+		if !ok {
+			return
+		}
+
+		msg.Attempts++
+		if err := handler(msg); err != nil {
+			delay := requeueDelay(err)
+			if delay < 0 {
+				delay = MemoryRequeueDelay
+			}
+			time.AfterFunc(delay, func() { sub.channel.push(msg) })
+		}
+	}
+}
+
+// Close stop the consumers after their in-flight message, ephemeral channels are removed
+func (sub *memorySubscription) Close() error {
+	sub.once.Do(func() {
+		close(sub.quit)
+		sub.wg.Wait()
+
+		b := sub.backend
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, sub)
+		sub.channel.consumers--
+		if sub.channel.ephemeral && sub.channel.consumers == 0 {
+			delete(b.topics[sub.topic].channels, sub.name)
+		}
+	})
+
+	return nil
+}
+
+func (ch *memoryChannel) push(msg *Message) {
+	ch.mu.Lock()
+	ch.messages = append(ch.messages, msg)
+	ch.mu.Unlock()
+
+	ch.signal()
+}
+
+// pop wait for the next message, false when quit is closed
+func (ch *memoryChannel) pop(quit chan struct{}) (*Message, bool) {
+	for {
+		select {
+		case <-quit:
+			return nil, false
+		default:
+		}
+
+		ch.mu.Lock()
+		if len(ch.messages) > 0 {
+			msg := ch.messages[0]
+			ch.messages = ch.messages[1:]
+			remaining := len(ch.messages)
+			ch.mu.Unlock()
+
+			// wake up the next consumer of the channel
+			if remaining > 0 {
+				ch.signal()
+			}
+			return msg, true
+		}
+		ch.mu.Unlock()
+
+		select {
+		case <-ch.ready:
+		case <-quit:
+			return nil, false
+		}
+	}
+}
+
+func (ch *memoryChannel) signal() {
+	select {
+	case ch.ready <- struct{}{}:
+	default:
+	}
+}
+
+func copyMessage(msg *Message, channel string) *Message {
+	cp := *msg
+	cp.Channel = channel
+	return &cp
+}
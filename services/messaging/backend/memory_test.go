@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func collect(t *testing.T, b Backend, topic, channel string, received chan<- string) Subscription {
+	sub, err := b.Subscribe(MSGBackendSubscReq{
+		Topic:   topic,
+		Channel: channel,
+		Handler: func(msg *Message) error {
+			received <- fmt.Sprintf("%v:%v", channel, string(msg.Body))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+func waitMessages(t *testing.T, received <-chan string, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-received:
+			counts[msg]++
+		case <-time.After(time.Second):
+			t.Fatalf("received %v of %v messages", i, n)
+		}
+	}
+
+	return counts
+}
+
+func TestMemoryBackendChannels(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	received := make(chan string, 10)
+	// published before any channel, kept for the first one
+	b.Publish(MSGBackendPubReq{Topic: "events", Body: []byte("early")})
+
+	collect(t, b, "events", "indexer", received)
+	collect(t, b, "events", "mailer", received)
+	// second consumer of the same channel shares the messages
+	collect(t, b, "events", "mailer", received)
+
+	b.Publish(MSGBackendPubReq{Topic: "events", Body: []byte("hello")})
+
+	counts := waitMessages(t, received, 3)
+	for _, want := range []string{"indexer:early", "indexer:hello", "mailer:hello"} {
+		if counts[want] != 1 {
+			t.Errorf("received %v %v times, want once (all: %v)", want, counts[want], counts)
+		}
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected extra message %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBackendRequeue(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	var mu sync.Mutex
+	var attempts []uint16
+	done := make(chan struct{})
+	b.Subscribe(MSGBackendSubscReq{
+		Topic:   "jobs",
+		Channel: "worker",
+		Handler: func(msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, msg.Attempts)
+			if msg.Attempts < 3 {
+				return RequeueAfter(time.Millisecond, fmt.Errorf("not yet"))
+			}
+			close(done)
+			return nil
+		},
+	})
+	b.Publish(MSGBackendPubReq{Topic: "jobs", Body: []byte("job")})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("message was not redelivered")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("attempts=%v, want [1 2 3]", attempts)
+	}
+}
+
+func TestMemoryBackendClose(t *testing.T) {
+	b := NewMemoryBackend()
+
+	received := make(chan string, 10)
+	sub := collect(t, b, "events", "", received)
+	b.Publish(MSGBackendPubReq{Topic: "events", Body: []byte("one")})
+	waitMessages(t, received, 1)
+
+	sub.Close()
+	b.Publish(MSGBackendPubReq{Topic: "events", Body: []byte("two")})
+	select {
+	case msg := <-received:
+		t.Errorf("closed subscription received %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Close()
+	if err := b.Health(); err == nil {
+		t.Error("closed backend must be unhealthy")
+	}
+	if err := b.Publish(MSGBackendPubReq{Topic: "events"}); err == nil {
+		t.Error("closed backend must reject publish")
+	}
+}
+
+func TestMemoryRequestReply(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	if _, err := b.Respond("rpc_echo", "workers", func(msg *Message) ([]byte, error) {
+		if string(msg.Body) == "fail" {
+			return nil, fmt.Errorf("bad request")
+		}
+		return append([]byte("echo "), msg.Body...), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := Request(b, "rpc_echo", []byte("hello"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "echo hello" {
+		t.Errorf("expected echo hello, got %q", reply)
+	}
+
+	if _, err := Request(b, "rpc_echo", []byte("fail"), time.Second); err == nil || !strings.Contains(err.Error(), "bad request") {
+		t.Errorf("expected the responder error, got %v", err)
+	}
+
+	if _, err := Request(b, "rpc_nobody", []byte("hello"), 50*time.Millisecond); err != ErrRequestTimeout {
+		t.Errorf("expected ErrRequestTimeout, got %v", err)
+	}
+}
+
+func TestMemoryConcurrentRequests(t *testing.T) {
+	b := NewMemoryBackend()
+	defer b.Close()
+
+	if _, err := b.Respond("rpc_echo", "workers", func(msg *Message) ([]byte, error) {
+		return msg.Body, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("request %v", i)
+			if reply, err := Request(b, "rpc_echo", []byte(body), time.Second); err != nil || string(reply) != body {
+				t.Errorf("reply=%q err=%v, want %q", reply, err, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRPCDuplicateReply(t *testing.T) {
+	rpc := newRPCEmulator(NewMemoryBackend(), rpcReplyTopic(), "")
+	ch := make(chan rpcEnvelope, 1)
+	rpc.pending["id"] = ch
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			rpc.handleReply(&Message{Body: []byte(`{"correlation_id":"id","body":"b2s="}`)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a redelivered reply blocked the reply consumer")
+	}
+	if reply := <-ch; string(reply.Body) != "ok" {
+		t.Errorf("reply=%q", reply.Body)
+	}
+}
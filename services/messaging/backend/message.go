@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type (
+	// Message consumed message passed to the subscription handler
+	Message struct {
+		ID        string
+		Topic     string
+		Channel   string
+		Body      []byte
+		Attempts  uint16
+		Timestamp time.Time
+
+		ctx context.Context
+	}
+
+	// MessageHandler subscription handler, returning nil acknowledges the message
+	// and returning an error requeues it, see RequeueAfter for an explicit delay
+	MessageHandler func(*Message) error
+
+	// Subscription handle of an active subscription
+	Subscription interface {
+		// Close stop consuming, in-flight messages are finished first
+		Close() error
+	}
+
+	// RequeueError handler error requeueing the message after Delay
+	RequeueError struct {
+		Err   error
+		Delay time.Duration
+	}
+)
+
+// Context context of the message, set by the middlewares with WithContext
+func (msg *Message) Context() context.Context {
+	if msg.ctx == nil {
+		return context.Background()
+	}
+
+	return msg.ctx
+}
+
+// WithContext set the context passed to the next handlers
+func (msg *Message) WithContext(ctx context.Context) {
+	msg.ctx = ctx
+}
+
+// RequeueAfter return an error requeueing the message after delay
+func RequeueAfter(delay time.Duration, err error) error {
+	return &RequeueError{Err: err, Delay: delay}
+}
+
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("requeue after %v: %v", e.Delay, e.Err)
+}
+
+// requeueDelay requeue delay of a handler error, -1 lets the backend pick its backoff
+func requeueDelay(err error) time.Duration {
+	if requeue, ok := err.(*RequeueError); ok {
+		return requeue.Delay
+	}
+
+	return -1
+}
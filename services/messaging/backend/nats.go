@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -15,18 +16,40 @@ var (
 	NC *nats.Conn
 )
 
+type (
+	// NATSSubscribeReq nats subscribe request, Queue maps to a nats queue group
+	NATSSubscribeReq struct {
+		Subject string
+		Queue   string
+		Handler MessageHandler
+	}
+
+	// NATSBackend nats messaging backend instance
+	NATSBackend struct {
+		conn *nats.Conn
+	}
+
+	natsSubscription struct {
+		sub *nats.Subscription
+	}
+)
+
+func init() {
+	Register("nats", BackendDriver{
+		New:          func() Backend { return &NATSBackend{} },
+		RemoteConfig: true,
+	})
+}
+
 // StartNATS start nats connection and settings
 func StartNATS(conf MSGBackendConfig) error {
-	fmt.Println(conf)
-
-	hosts := natsHosts(conf)
-	nc, err := nats.Connect(hosts)
-	if err != nil {
-		utils.Error(fmt.Sprintf("error StartNATS %v", err))
+	b := &NATSBackend{}
+	if err := b.Connect(conf); err != nil {
 		return err
 	}
 
-	setNATSConn(nc)
+	SetBackend(b)
+	setNATSConn(b.conn)
 
 	return nil
 }
@@ -54,10 +77,47 @@ func natsHosts(conf MSGBackendConfig) string {
 
 }
 
+// NATSSubscribe subscribe to a nats subject on the backend started by StartNATS
+func NATSSubscribe(req NATSSubscribeReq) (Subscription, error) {
+	b, ok := GetBackend().(*NATSBackend)
+	if !ok {
+		return nil, fmt.Errorf("NATSSubscribe nats is not started")
+	}
+
+	return b.Subscribe(MSGBackendSubscReq{
+		Topic:   req.Subject,
+		Channel: req.Queue,
+		Handler: req.Handler,
+	})
+}
+
 // NATSPublish nats publish interface
 func NATSPublish(req NSQPubReq) error {
+	b, ok := GetBackend().(*NATSBackend)
+	if !ok {
+		return fmt.Errorf("NATSPublish nats is not started")
+	}
+
+	return b.Publish(MSGBackendPubReq{Topic: req.Topic, Body: req.Body})
+}
+
+// Connect connect to the nats hosts of conf.Env.Host
+func (b *NATSBackend) Connect(conf MSGBackendConfig) error {
+	hosts := natsHosts(conf)
+	nc, err := nats.Connect(hosts)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error StartNATS %v", err))
+		return err
+	}
+
+	b.conn = nc
+	return nil
+}
+
+// Publish publish to a nats subject
+func (b *NATSBackend) Publish(req MSGBackendPubReq) error {
 	s := time.Now()
-	if err := getNATSConn().Publish(req.Topic, req.Body); err != nil {
+	if err := b.conn.Publish(req.Topic, req.Body); err != nil {
 		utils.Error(fmt.Sprintf("error NATSPublish %v", err))
 		return err
 	}
@@ -65,3 +125,149 @@ func NATSPublish(req NSQPubReq) error {
 	utils.Info(fmt.Sprintf("NATSPublish took: %v chan=%v", time.Since(s), req.Topic))
 	return nil
 }
+
+// Subscribe subscribe to a nats subject, subscribers sharing a Channel form a queue group
+// and each message is delivered to one of them. Core nats delivers at most once without
+// acks: handler errors, RequeueAfter included, are logged and the message is lost
+func (b *NATSBackend) Subscribe(req MSGBackendSubscReq) (Subscription, error) {
+	if req.Handler == nil {
+		return nil, fmt.Errorf("NATSSubscribe handler is required subject=%v", req.Topic)
+	}
+	if b.conn == nil {
+		return nil, fmt.Errorf("NATSSubscribe nats is not connected")
+	}
+
+	handler := func(m *nats.Msg) {
+		msg := &Message{
+			Topic:     m.Subject,
+			Channel:   req.Channel,
+			Body:      m.Data,
+			Attempts:  1,
+			Timestamp: time.Now(),
+		}
+		if err := req.Handler(msg); err != nil {
+			if requeueDelay(err) >= 0 {
+				utils.Error(fmt.Sprintf("error NATSSubscribe requeue is not supported by core nats, message dropped subject=%v queue=%v err=%v", req.Topic, req.Channel, err))
+				return
+			}
+			utils.Error(fmt.Sprintf("error NATSSubscribe handler subject=%v queue=%v err=%v", req.Topic, req.Channel, err))
+		}
+	}
+
+	var (
+		sub *nats.Subscription
+		err error
+	)
+	if req.Channel != "" {
+		sub, err = b.conn.QueueSubscribe(req.Topic, req.Channel, handler)
+	} else {
+		sub, err = b.conn.Subscribe(req.Topic, handler)
+	}
+	if err != nil {
+		utils.Error(fmt.Sprintf("error NATSSubscribe %v", err))
+		return nil, err
+	}
+
+	utils.Info(fmt.Sprintf("NATSSubscribe listening.. subject=%v queue=%v", req.Topic, req.Channel))
+	return &natsSubscription{sub: sub}, nil
+}
+
+// Request nats native request, the reply is the envelope sent by Respond
+func (b *NATSBackend) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	if b.conn == nil {
+		return nil, fmt.Errorf("NATSRequest nats is not connected")
+	}
+
+	m, err := b.conn.Request(topic, body, timeout)
+	if err != nil {
+		if err == nats.ErrTimeout {
+			return nil, ErrRequestTimeout
+		}
+		return nil, err
+	}
+
+	var reply rpcEnvelope
+	if err := json.Unmarshal(m.Data, &reply); err != nil {
+		return nil, fmt.Errorf("NATSRequest invalid reply: %v", err)
+	}
+
+	return replyResult(reply)
+}
+
+// Respond answer the nats requests on topic with a queue group per channel
+func (b *NATSBackend) Respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	if b.conn == nil {
+		return nil, fmt.Errorf("NATSRespond nats is not connected")
+	}
+
+	cb := func(m *nats.Msg) {
+		if m.Reply == "" {
+			utils.Error(fmt.Sprintf("error NATSRespond message without reply subject=%v", topic))
+			return
+		}
+
+		msg := &Message{
+			Topic:     m.Subject,
+			Channel:   channel,
+			Body:      m.Data,
+			Attempts:  1,
+			Timestamp: time.Now(),
+		}
+		data, err := json.Marshal(replyEnvelope("", handler, msg))
+		if err != nil {
+			utils.Error(fmt.Sprintf("error NATSRespond %v", err))
+			return
+		}
+		if err := b.conn.Publish(m.Reply, data); err != nil {
+			utils.Error(fmt.Sprintf("error NATSRespond publish reply %v", err))
+		}
+	}
+
+	var (
+		sub *nats.Subscription
+		err error
+	)
+	if channel != "" {
+		sub, err = b.conn.QueueSubscribe(topic, channel, cb)
+	} else {
+		sub, err = b.conn.Subscribe(topic, cb)
+	}
+	if err != nil {
+		utils.Error(fmt.Sprintf("error NATSRespond %v", err))
+		return nil, err
+	}
+
+	return &natsSubscription{sub: sub}, nil
+}
+
+// Close drain the subscriptions and close the connection
+func (b *NATSBackend) Close() error {
+	if b.conn == nil {
+		return nil
+	}
+
+	// Drain unsubscribes all subscriptions, handles the pending messages and closes the connection
+	return b.conn.Drain()
+}
+
+// Redelivers core nats does not redeliver failed messages, see WithRedelivery
+func (b *NATSBackend) Redelivers() bool {
+	return false
+}
+
+// Health check the nats connection status
+func (b *NATSBackend) Health() error {
+	if b.conn == nil {
+		return fmt.Errorf("nats is not connected")
+	}
+	if status := b.conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection status=%v lastError=%v", status, b.conn.LastError())
+	}
+
+	return nil
+}
+
+// Close drain the subscription, pending messages are handled before it is removed
+func (sub *natsSubscription) Close() error {
+	return sub.sub.Drain()
+}
@@ -28,13 +28,57 @@ type (
 
 	// NSQConsumerReq nsq new consumer request
 	NSQConsumerReq struct {
-		Topic   string
-		Channel string
+		Topic       string
+		Channel     string
+		Handler     MessageHandler
+		Concurrency int
 	}
+
+	// NSQBackend nsq messaging backend instance
+	NSQBackend struct {
+		conf      MSGBackendConfig
+		config    *nsq.Config
+		producers *nsqProducerPool
+		rpc       *rpcEmulator
+
+		mu   sync.Mutex
+		subs map[*nsqSubscription]bool
+	}
+
+	nsqSubscription struct {
+		backend  *NSQBackend
+		consumer *nsq.Consumer
+	}
+)
+
+var (
+	// NSQDefaultConcurrency default number of concurrent handlers per consumer
+	NSQDefaultConcurrency = 100
 )
 
+func init() {
+	Register("nsq", BackendDriver{
+		New:          func() Backend { return &NSQBackend{} },
+		RemoteConfig: true,
+	})
+}
+
 // StartNSQ start nsq connection
 func StartNSQ(conf MSGBackendConfig) error {
+	b := &NSQBackend{}
+	if err := b.Connect(conf); err != nil {
+		return err
+	}
+
+	SetBackend(b)
+	NSQSetConfigConn(b.config)
+	NSQProducer = b.producers.get(0)
+	// TestConn()
+	return nil
+
+}
+
+func newNSQConfig() *nsq.Config {
 	config := nsq.NewConfig()
 	config.Set("OutputBufferSize", 0)
 	config.Set("OutputBufferTimeout", time.Duration(1)*time.Millisecond)
@@ -43,14 +87,7 @@ func StartNSQ(conf MSGBackendConfig) error {
 	config.Set("LookupdPollJitter", 0)
 	config.Set("Snappy", true)
 
-	// utils.Info(fmt.Sprintf("nsq host=%v", config.Hostname))
-	if err := NSQCreateProducer(conf, NSQSetConfigConn(config)); err != nil {
-		return err
-	}
-
-	// TestConn()
-	return nil
-
+	return config
 }
 
 // NSQCreateProducer create nsq producer
@@ -65,45 +102,192 @@ func NSQCreateProducer(conf MSGBackendConfig, config *nsq.Config) error {
 	return nil
 }
 
-func createProducer(conf MSGBackendConfig, config *nsq.Config) (*nsq.Producer, error) {
-	w, err := nsq.NewProducer(conf.Env.Host, config)
+// NSQCreateConsumer create nsq consumer conn on the backend started by StartNSQ
+func NSQCreateConsumer(conf MSGBackendConfig, req NSQConsumerReq) (Subscription, error) {
+	b, ok := GetBackend().(*NSQBackend)
+	if !ok {
+		return nil, fmt.Errorf("NSQCreateConsumer nsq is not started")
+	}
+
+	return b.Subscribe(MSGBackendSubscReq{
+		Topic:       req.Topic,
+		Channel:     req.Channel,
+		Handler:     req.Handler,
+		Concurrency: req.Concurrency,
+	})
+}
+
+// Connect create the pool of nsq producers for the comma separated nsqd hosts of conf.Env.Host
+func (b *NSQBackend) Connect(conf MSGBackendConfig) error {
+	config := newNSQConfig()
+
+	// utils.Info(fmt.Sprintf("nsq host=%v", config.Hostname))
+	producers, err := newNSQProducerPool(conf.Env.Host, nsqProducerPoolSize(), config)
 	if err != nil {
 		utils.Error(fmt.Sprintf("error StartNSQ connection %v", err))
-		return w, err
+		return err
 	}
-	w.Ping()
 
-	return w, nil
+	b.conf = conf
+	b.config = config
+	b.producers = producers
+	// replies are consumed on an ephemeral topic removed by nsqd once the requester is gone
+	b.rpc = newRPCEmulator(b, rpcReplyTopic()+"#ephemeral", "reply#ephemeral")
+	return nil
 }
 
-// NSQCreateConsumer create nsq consumer conn
-func NSQCreateConsumer(conf MSGBackendConfig, req NSQConsumerReq) error {
-	utils.Info(fmt.Sprintf("NSQCreateConsumer listen start.. chan=%v topic=%v", req.Channel, req.Topic))
-	config := NSQGetConfigConn()
+// Publish publish to nsq with a pooled producer
+func (b *NSQBackend) Publish(req MSGBackendPubReq) error {
+	e := time.Now()
+	if b.producers == nil {
+		return fmt.Errorf("NSQPublish nsq is not connected")
+	}
+
+	if err := b.producers.publish(func(w *nsq.Producer) error {
+		return w.Publish(req.Topic, req.Body)
+	}); err != nil {
+		utils.Error(fmt.Sprintf("error NSQPublish Publish %v", err))
+		return err
+	}
 
-	if (&nsq.Config{}) == config {
-		fmt.Println("config not set!")
+	utils.Info(fmt.Sprintf("NSQPublish took: %v topic=%v", time.Since(e), req.Topic))
+	return nil
+}
+
+// MultiPublish publish a batch of bodies to topic in a single round trip
+func (b *NSQBackend) MultiPublish(topic string, bodies [][]byte) error {
+	e := time.Now()
+	if b.producers == nil {
+		return fmt.Errorf("NSQMultiPublish nsq is not connected")
 	}
 
-	q, err := nsq.NewConsumer(req.Topic, req.Channel, config)
+	if err := b.producers.publish(func(w *nsq.Producer) error {
+		return w.MultiPublish(topic, bodies)
+	}); err != nil {
+		utils.Error(fmt.Sprintf("error NSQMultiPublish %v", err))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("NSQMultiPublish took: %v topic=%v len(%v)", time.Since(e), topic, len(bodies)))
+	return nil
+}
+
+// Subscribe create nsq consumer conn, messages are finished when the handler
+// returns nil and requeued when it returns an error
+func (b *NSQBackend) Subscribe(req MSGBackendSubscReq) (Subscription, error) {
+	utils.Info(fmt.Sprintf("NSQCreateConsumer listen start.. chan=%v topic=%v", req.Channel, req.Topic))
+	if req.Handler == nil {
+		return nil, fmt.Errorf("NSQCreateConsumer handler is required topic=%v", req.Topic)
+	}
+	if b.config == nil {
+		return nil, fmt.Errorf("NSQCreateConsumer nsq is not connected")
+	}
+
+	q, err := nsq.NewConsumer(req.Topic, req.Channel, b.config)
 	if err != nil {
 		utils.Error(fmt.Sprintf("error NSQCreateConsumer %v", err))
-		return err
+		return nil, err
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = NSQDefaultConcurrency
 	}
 
 	utils.Info(fmt.Sprintf("NSQCreateConsumer listening.. chan=%v topic=%v", req.Channel, req.Topic))
 	q.AddConcurrentHandlers(nsq.HandlerFunc(func(message *nsq.Message) error {
-		fmt.Printf("got a message %v\n", string(message.Body))
-		// wg.Done()
+		message.DisableAutoResponse()
+
+		msg := &Message{
+			ID:        string(message.ID[:]),
+			Topic:     req.Topic,
+			Channel:   req.Channel,
+			Body:      message.Body,
+			Attempts:  message.Attempts,
+			Timestamp: time.Unix(0, message.Timestamp),
+		}
+		if err := req.Handler(msg); err != nil {
+			utils.Error(fmt.Sprintf("error NSQCreateConsumer handler topic=%v chan=%v attempts=%v err=%v", req.Topic, req.Channel, message.Attempts, err))
+			message.Requeue(requeueDelay(err))
+			return nil
+		}
+
+		message.Finish()
 		return nil
-	}), 100)
+	}), concurrency)
 
-	hosts := []string{conf.Env.Host}
+	hosts := splitNSQHosts(b.conf.Env.Host)
 	if err := q.ConnectToNSQLookupds(hosts); err != nil {
 		utils.Error(fmt.Sprintf("can't connect to nsq err=%v hosts=%v", err, hosts))
+		q.Stop()
+		return nil, err
+	}
+
+	sub := &nsqSubscription{backend: b, consumer: q}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = map[*nsqSubscription]bool{}
+	}
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	return sub, nil
+}
+
+// Request publish a request and wait for its reply, emulated with a reply topic and correlation IDs
+func (b *NSQBackend) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	if b.rpc == nil {
+		return nil, fmt.Errorf("NSQRequest nsq is not connected")
+	}
+
+	return b.rpc.request(topic, body, timeout)
+}
+
+// Respond answer the requests published to topic on channel
+func (b *NSQBackend) Respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	if b.rpc == nil {
+		return nil, fmt.Errorf("NSQRespond nsq is not connected")
 	}
 
-	// wg.Wait()
+	return b.rpc.respond(topic, channel, handler)
+}
+
+// Close stop the consumers and the producer
+func (b *NSQBackend) Close() error {
+	b.mu.Lock()
+	var subs []*nsqSubscription
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	if b.producers != nil {
+		b.producers.stop()
+	}
+
+	return nil
+}
+
+// Health ping nsqd
+func (b *NSQBackend) Health() error {
+	if b.producers == nil {
+		return fmt.Errorf("nsq is not connected")
+	}
+
+	return b.producers.ping()
+}
+
+// Close stop the consumer and wait until in-flight messages are handled
+func (sub *nsqSubscription) Close() error {
+	sub.consumer.Stop()
+	<-sub.consumer.StopChan
+
+	sub.backend.mu.Lock()
+	delete(sub.backend.subs, sub)
+	sub.backend.mu.Unlock()
 	return nil
 }
 
@@ -180,16 +364,20 @@ func TestConnSeq() error {
 
 // NSQPublish nsq publish from nsq producer
 func NSQPublish(req NSQPubReq) error {
-	e := time.Now()
+	b, ok := GetBackend().(*NSQBackend)
+	if !ok {
+		return fmt.Errorf("NSQPublish nsq is not started")
+	}
 
-	producer, _ := createProducer(GetMSGBackendConfig(), NSQGetConfigConn())
-	defer producer.Stop()
+	return b.Publish(MSGBackendPubReq{Topic: req.Topic, Body: req.Body})
+}
 
-	if err := producer.DeferredPublish(req.Topic, time.Duration(1)*time.Millisecond, req.Body); err != nil {
-		utils.Error(fmt.Sprintf("error NSQPublish Publish %v", err))
-		return err
+// NSQMultiPublish nsq publish a batch of bodies to topic
+func NSQMultiPublish(topic string, bodies [][]byte) error {
+	b, ok := GetBackend().(*NSQBackend)
+	if !ok {
+		return fmt.Errorf("NSQMultiPublish nsq is not started")
 	}
 
-	utils.Info(fmt.Sprintf("NSQPublish took: %v topic=%v", time.Since(e), req.Topic))
-	return nil
+	return b.MultiPublish(topic, bodies)
 }
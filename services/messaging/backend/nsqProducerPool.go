@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/helpers"
+)
+
+var (
+	// NSQProducerPoolSizeENV number of producers kept per nsqd
+	NSQProducerPoolSizeENV = "NSQ_PRODUCER_POOL_SIZE"
+
+	defaultNSQProducerPoolSize = 2
+)
+
+type (
+	// nsqProducerPool long-lived producers for every nsqd host, publishes are
+	// spread round-robin and fail over to the next producer on error
+	nsqProducerPool struct {
+		mu        sync.RWMutex
+		config    *nsq.Config
+		hosts     []string
+		producers []*nsq.Producer
+		next      uint32
+	}
+)
+
+// newNSQProducerPool create size producers for each of the comma separated nsqd hosts
+func newNSQProducerPool(hosts string, size int, config *nsq.Config) (*nsqProducerPool, error) {
+	if size <= 0 {
+		size = 1
+	}
+
+	pool := &nsqProducerPool{config: config}
+	for _, host := range splitNSQHosts(hosts) {
+		for i := 0; i < size; i++ {
+			w, err := nsq.NewProducer(host, config)
+			if err != nil {
+				pool.stop()
+				return nil, err
+			}
+			// connect eagerly, a failing nsqd is retried on publish
+			if err := w.Ping(); err != nil {
+				utils.Error(fmt.Sprintf("error nsq producer ping host=%v err=%v", host, err))
+			}
+
+			pool.hosts = append(pool.hosts, host)
+			pool.producers = append(pool.producers, w)
+		}
+	}
+	if len(pool.producers) == 0 {
+		return nil, fmt.Errorf("no nsqd host in %q", hosts)
+	}
+
+	utils.Info(fmt.Sprintf("nsq producer pool ready, producers=%v hosts=%v", len(pool.producers), hosts))
+	return pool, nil
+}
+
+func nsqProducerPoolSize() int {
+	return helpers.GetEnvIntValue(NSQProducerPoolSizeENV, defaultNSQProducerPoolSize)
+}
+
+// publish run fn with the next producer, failing over to the following ones
+// and reconnecting the producers that failed
+func (pool *nsqProducerPool) publish(fn func(*nsq.Producer) error) error {
+	n := uint32(len(pool.producers))
+	start := atomic.AddUint32(&pool.next, 1)
+
+	var lastErr error
+	for i := uint32(0); i < n; i++ {
+		slot := int((start + i) % n)
+
+		producer := pool.get(slot)
+		if err := fn(producer); err != nil {
+			utils.Error(fmt.Sprintf("error nsq publish host=%v err=%v", pool.hosts[slot], err))
+			lastErr = err
+			pool.reconnect(slot, producer)
+			continue
+		}
+
+		return nil
+	}
+
+	return lastErr
+}
+
+func (pool *nsqProducerPool) get(slot int) *nsq.Producer {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.producers[slot]
+}
+
+// reconnect replace the failed producer of slot, unless another publish already did
+func (pool *nsqProducerPool) reconnect(slot int, failed *nsq.Producer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.producers[slot] != failed {
+		return
+	}
+
+	w, err := nsq.NewProducer(pool.hosts[slot], pool.config)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error nsq producer reconnect host=%v err=%v", pool.hosts[slot], err))
+		return
+	}
+
+	failed.Stop()
+	pool.producers[slot] = w
+}
+
+// ping ping every producer, healthy while at least one nsqd answers
+func (pool *nsqProducerPool) ping() error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	var failed []string
+	for i, producer := range pool.producers {
+		if err := producer.Ping(); err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", pool.hosts[i], err))
+		}
+	}
+	if len(failed) == len(pool.producers) {
+		return fmt.Errorf("nsq producers unreachable %v", failed)
+	}
+
+	return nil
+}
+
+func (pool *nsqProducerPool) stop() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, producer := range pool.producers {
+		producer.Stop()
+	}
+}
+
+// splitNSQHosts hosts of a comma separated host list
+func splitNSQHosts(hosts string) []string {
+	var split []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			split = append(split, host)
+		}
+	}
+
+	return split
+}
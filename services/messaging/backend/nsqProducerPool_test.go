@@ -0,0 +1,13 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitNSQHosts(t *testing.T) {
+	got := splitNSQHosts("nsq1:4161, nsq2:4161,,")
+	if !reflect.DeepEqual(got, []string{"nsq1:4161", "nsq2:4161"}) {
+		t.Errorf("splitNSQHosts=%v", got)
+	}
+}
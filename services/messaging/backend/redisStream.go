@@ -0,0 +1,688 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/services/database"
+)
+
+type (
+	// RedisStreamBackend messaging backend on redis streams, select it with MESSAGING_BACKEND=redis.
+	// Topics are streams and channels are consumer groups, an empty channel subscribes with a
+	// temporary group removed on close. A message is acknowledged when the handler returns nil,
+	// otherwise it stays pending and is reclaimed once idle for RedisStreamReclaimIdle.
+	// Consumers are named after the host, on close their pending entries are handed off to
+	// another consumer of the group before the consumer is deleted
+	RedisStreamBackend struct {
+		// Pool redis pool, database.RedisPool when not set
+		Pool *redis.Pool
+
+		rpc *rpcEmulator
+
+		mu        sync.Mutex
+		subs      map[*redisStreamSubscription]bool
+		consumers map[string]bool
+	}
+
+	redisStreamSubscription struct {
+		backend   *RedisStreamBackend
+		topic     string
+		group     string
+		consumer  string
+		ephemeral bool
+		handler   MessageHandler
+		quit      chan struct{}
+		wg        sync.WaitGroup
+		once      sync.Once
+	}
+
+	redisStreamPending struct {
+		ID         string
+		Consumer   string
+		Idle       int64
+		Deliveries int64
+	}
+
+	redisStreamConsumer struct {
+		Name    string
+		Pending int64
+	}
+
+	redisStreamEntry struct {
+		ID       string
+		Body     []byte
+		Attempts uint16
+		// Trimmed entry deleted by trimming while pending, only acked
+		Trimmed bool
+	}
+)
+
+var (
+	// RedisStreamMaxLen approximate number of entries kept per stream, 0 to never trim
+	RedisStreamMaxLen = 100000
+
+	// RedisStreamBlock how long a consumer blocks waiting for new entries, bounds the time to close
+	RedisStreamBlock = 2 * time.Second
+
+	// RedisStreamReclaimIdle idle time after which a pending entry is redelivered
+	RedisStreamReclaimIdle = 30 * time.Second
+
+	// RedisStreamReclaimInterval how often the pending entries of a group are checked
+	RedisStreamReclaimInterval = 5 * time.Second
+
+	// redisStreamBodyField stream entry field holding the message body
+	redisStreamBodyField = "body"
+
+	// redisStreamPendingPage number of pending entries read per XPENDING
+	redisStreamPendingPage = 100
+)
+
+func init() {
+	Register("redis", BackendDriver{
+		New: func() Backend { return &RedisStreamBackend{} },
+	})
+}
+
+// Connect use database.RedisPool, starting it when needed, unless Pool is set
+func (b *RedisStreamBackend) Connect(conf MSGBackendConfig) error {
+	if b.Pool == nil {
+		if database.RedisPool == nil {
+			database.StartRedis()
+		}
+		b.Pool = database.RedisPool
+	}
+	if b.Pool == nil {
+		return fmt.Errorf("redis pool is not started")
+	}
+
+	b.rpc = newRPCEmulator(b, rpcReplyTopic(), "")
+	return b.Health()
+}
+
+// Publish append the body to the stream of the topic
+func (b *RedisStreamBackend) Publish(req MSGBackendPubReq) error {
+	conn := b.Pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("XADD", redisStreamAddArgs(req.Topic, req.Body)...); err != nil {
+		utils.Error(fmt.Sprintf("error RedisStreamPublish topic=%v err=%v", req.Topic, err))
+		return err
+	}
+
+	return nil
+}
+
+// MultiPublish append the bodies to the stream of the topic in a single pipeline
+func (b *RedisStreamBackend) MultiPublish(topic string, bodies [][]byte) error {
+	conn := b.Pool.Get()
+	defer conn.Close()
+
+	for _, body := range bodies {
+		if err := conn.Send("XADD", redisStreamAddArgs(topic, body)...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for range bodies {
+		if _, err := conn.Receive(); err != nil {
+			utils.Error(fmt.Sprintf("error RedisStreamMultiPublish topic=%v err=%v", topic, err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Subscribe create the consumer group of the channel if needed and start Concurrency consumers
+func (b *RedisStreamBackend) Subscribe(req MSGBackendSubscReq) (Subscription, error) {
+	if req.Handler == nil {
+		return nil, fmt.Errorf("RedisStreamSubscribe handler is required topic=%v", req.Topic)
+	}
+	if b.Pool == nil {
+		return nil, fmt.Errorf("RedisStreamSubscribe redis is not connected")
+	}
+
+	sub := &redisStreamSubscription{
+		backend: b,
+		topic:   req.Topic,
+		group:   req.Channel,
+		handler: req.Handler,
+		quit:    make(chan struct{}),
+	}
+	if sub.group == "" {
+		sub.group = fmt.Sprintf("ephemeral_%v", utils.GenerateUUID())
+		sub.ephemeral = true
+	}
+	sub.consumer = b.acquireConsumer(sub.topic, sub.group)
+
+	if err := sub.createGroup(); err != nil {
+		b.releaseConsumer(sub.topic, sub.group, sub.consumer)
+		utils.Error(fmt.Sprintf("error RedisStreamSubscribe topic=%v group=%v err=%v", sub.topic, sub.group, err))
+		return nil, err
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		sub.wg.Add(1)
+		go sub.consume()
+	}
+	sub.wg.Add(1)
+	go sub.reclaim()
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = map[*redisStreamSubscription]bool{}
+	}
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	utils.Info(fmt.Sprintf("RedisStreamSubscribe listening.. topic=%v group=%v consumer=%v", sub.topic, sub.group, sub.consumer))
+	return sub, nil
+}
+
+// Request publish a request and wait for its reply
+func (b *RedisStreamBackend) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	if b.rpc == nil {
+		return nil, fmt.Errorf("RedisStreamRequest redis is not connected")
+	}
+
+	return b.rpc.request(topic, body, timeout)
+}
+
+// Respond answer the requests published to topic on channel
+func (b *RedisStreamBackend) Respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	if b.rpc == nil {
+		return nil, fmt.Errorf("RedisStreamRespond redis is not connected")
+	}
+
+	return b.rpc.respond(topic, channel, handler)
+}
+
+// Close stop the consumers, the pool is shared and left open
+func (b *RedisStreamBackend) Close() error {
+	b.mu.Lock()
+	var subs []*redisStreamSubscription
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+
+	return nil
+}
+
+// acquireConsumer consumer name of a new subscription of the group, stable across restarts:
+// the hostname suffixed by the rank of the subscription of the group in the process
+func (b *RedisStreamBackend) acquireConsumer(topic, group string) string {
+	host, _ := os.Hostname()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.consumers == nil {
+		b.consumers = map[string]bool{}
+	}
+	for n := 1; ; n++ {
+		name := redisStreamConsumerName(host, n)
+		key := redisStreamConsumerKey(topic, group, name)
+		if !b.consumers[key] {
+			b.consumers[key] = true
+			return name
+		}
+	}
+}
+
+func (b *RedisStreamBackend) releaseConsumer(topic, group, name string) {
+	b.mu.Lock()
+	delete(b.consumers, redisStreamConsumerKey(topic, group, name))
+	b.mu.Unlock()
+}
+
+// Health ping redis
+func (b *RedisStreamBackend) Health() error {
+	if b.Pool == nil {
+		return fmt.Errorf("redis is not connected")
+	}
+
+	conn := b.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// createGroup create the consumer group at redisStreamGroupStart, creating the stream if needed
+func (sub *redisStreamSubscription) createGroup() error {
+	conn := sub.backend.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "CREATE", sub.topic, sub.group, redisStreamGroupStart(sub.topic, sub.ephemeral), "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	return nil
+}
+
+// consume read new entries for the group until the subscription is closed
+func (sub *redisStreamSubscription) consume() {
+	defer sub.wg.Done()
+
+	conn := sub.backend.Pool.Get()
+	defer conn.Close()
+
+	for {
+		select {
+		case <-sub.quit:
+			return
+		default:
+		}
+
+		reply, err := conn.Do("XREADGROUP", "GROUP", sub.group, sub.consumer,
+			"COUNT", 1, "BLOCK", int64(RedisStreamBlock/time.Millisecond),
+			"STREAMS", sub.topic, ">")
+		if err != nil {
+			utils.Error(fmt.Sprintf("error RedisStreamSubscribe read topic=%v group=%v err=%v", sub.topic, sub.group, err))
+			// a broken connection is replaced, the pool dials a new one
+			conn.Close()
+			if !sub.wait(time.Second) {
+				return
+			}
+			conn = sub.backend.Pool.Get()
+			continue
+		}
+
+		entries, err := parseRedisStreamRead(reply)
+		if err != nil {
+			utils.Error(fmt.Sprintf("error RedisStreamSubscribe parse topic=%v err=%v", sub.topic, err))
+			continue
+		}
+		for _, entry := range entries {
+			entry.Attempts = 1
+			sub.handle(conn, entry)
+		}
+	}
+}
+
+// reclaim claim the entries left pending by failed handlers or dead consumers and handle them again
+func (sub *redisStreamSubscription) reclaim() {
+	defer sub.wg.Done()
+
+	for sub.wait(RedisStreamReclaimInterval) {
+		conn := sub.backend.Pool.Get()
+		// page through the pending entries, handling each page before reading the next
+		for start := "-"; start != ""; {
+			entries, next, err := sub.claimIdle(conn, start)
+			if err != nil {
+				utils.Error(fmt.Sprintf("error RedisStreamSubscribe reclaim topic=%v group=%v err=%v", sub.topic, sub.group, err))
+			}
+			for _, entry := range entries {
+				sub.handle(conn, entry)
+			}
+			if err != nil {
+				break
+			}
+			start = next
+		}
+		conn.Close()
+	}
+}
+
+// claimIdle claim the idle entries of a page of the pending entries from start, next is
+// the start of the following page, empty after the last one
+func (sub *redisStreamSubscription) claimIdle(conn redis.Conn, start string) (entries []redisStreamEntry, next string, err error) {
+	minIdle := int64(RedisStreamReclaimIdle / time.Millisecond)
+
+	reply, err := redis.Values(conn.Do("XPENDING", sub.topic, sub.group, start, "+", redisStreamPendingPage))
+	if err != nil {
+		return nil, "", err
+	}
+
+	pending := parseRedisStreamPending(reply)
+	if len(reply) == redisStreamPendingPage && len(pending) != 0 {
+		next = redisStreamNextID(pending[len(pending)-1].ID)
+	}
+
+	for _, p := range pending {
+		if p.Idle < minIdle {
+			continue
+		}
+
+		claimed, err := conn.Do("XCLAIM", sub.topic, sub.group, sub.consumer, minIdle, p.ID)
+		if err != nil {
+			return entries, "", err
+		}
+		claimedEntries, err := parseRedisStreamEntries(claimed)
+		if err != nil {
+			return entries, "", err
+		}
+		for _, entry := range claimedEntries {
+			entry.Attempts = uint16(p.Deliveries + 1)
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, next, nil
+}
+
+// handOff give the pending entries of the consumer to another consumer of the group, marked
+// idle so they are reclaimed right away, then delete the consumer. Without other consumer
+// the entries stay with it until the subscription restarts under the same name
+func (sub *redisStreamSubscription) handOff(conn redis.Conn) error {
+	var ids []interface{}
+	for start := "-"; start != ""; {
+		reply, err := redis.Values(conn.Do("XPENDING", sub.topic, sub.group, start, "+", redisStreamPendingPage, sub.consumer))
+		if err != nil {
+			return err
+		}
+		pending := parseRedisStreamPending(reply)
+		for _, p := range pending {
+			ids = append(ids, p.ID)
+		}
+
+		start = ""
+		if len(reply) == redisStreamPendingPage && len(pending) != 0 {
+			start = redisStreamNextID(pending[len(pending)-1].ID)
+		}
+	}
+
+	if len(ids) != 0 {
+		consumers, err := redis.Values(conn.Do("XINFO", "CONSUMERS", sub.topic, sub.group))
+		if err != nil {
+			return err
+		}
+		other := redisStreamOtherConsumer(parseRedisStreamConsumers(consumers), sub.consumer)
+		if other == "" {
+			utils.Info(fmt.Sprintf("RedisStreamSubscribe close topic=%v group=%v consumer=%v keeps %v pending entries", sub.topic, sub.group, sub.consumer, len(ids)))
+			return nil
+		}
+
+		args := append([]interface{}{sub.topic, sub.group, other, 0}, ids...)
+		args = append(args, "IDLE", int64(RedisStreamReclaimIdle/time.Millisecond), "JUSTID")
+		if _, err := conn.Do("XCLAIM", args...); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("XGROUP", "DELCONSUMER", sub.topic, sub.group, sub.consumer)
+	return err
+}
+
+// handle run the handler, ack on success. On error the entry stays pending, a
+// RequeueAfter delay is applied by resetting its idle time
+func (sub *redisStreamSubscription) handle(conn redis.Conn, entry redisStreamEntry) {
+	if entry.Trimmed {
+		// nothing to deliver, ack so it leaves the pending list
+		sub.ack(conn, entry.ID)
+		return
+	}
+
+	msg := &Message{
+		ID:        entry.ID,
+		Topic:     sub.topic,
+		Channel:   sub.group,
+		Body:      entry.Body,
+		Attempts:  entry.Attempts,
+		Timestamp: redisStreamIDTime(entry.ID),
+	}
+
+	if err := sub.handler(msg); err != nil {
+		utils.Error(fmt.Sprintf("error RedisStreamSubscribe handler topic=%v group=%v attempts=%v err=%v", sub.topic, sub.group, entry.Attempts, err))
+
+		if delay := requeueDelay(err); delay >= 0 {
+			idle := RedisStreamReclaimIdle - delay
+			if idle < 0 {
+				idle = 0
+			}
+			if _, err := conn.Do("XCLAIM", sub.topic, sub.group, sub.consumer, 0, entry.ID,
+				"IDLE", int64(idle/time.Millisecond), "JUSTID"); err != nil {
+				utils.Error(fmt.Sprintf("error RedisStreamSubscribe requeue id=%v err=%v", entry.ID, err))
+			}
+		}
+		return
+	}
+
+	sub.ack(conn, entry.ID)
+}
+
+func (sub *redisStreamSubscription) ack(conn redis.Conn, id string) {
+	if _, err := conn.Do("XACK", sub.topic, sub.group, id); err != nil {
+		utils.Error(fmt.Sprintf("error RedisStreamSubscribe ack id=%v err=%v", id, err))
+	}
+}
+
+// wait sleep for d, false when the subscription is closed
+func (sub *redisStreamSubscription) wait(d time.Duration) bool {
+	select {
+	case <-sub.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Close stop the consumers after their blocking read, the temporary group of an empty channel is destroyed
+func (sub *redisStreamSubscription) Close() error {
+	sub.once.Do(func() {
+		close(sub.quit)
+		sub.wg.Wait()
+
+		conn := sub.backend.Pool.Get()
+		if sub.ephemeral {
+			if _, err := conn.Do("XGROUP", "DESTROY", sub.topic, sub.group); err != nil {
+				utils.Error(fmt.Sprintf("error RedisStreamSubscribe destroy group=%v err=%v", sub.group, err))
+			}
+		} else if err := sub.handOff(conn); err != nil {
+			utils.Error(fmt.Sprintf("error RedisStreamSubscribe hand off group=%v consumer=%v err=%v", sub.group, sub.consumer, err))
+		}
+		conn.Close()
+
+		sub.backend.releaseConsumer(sub.topic, sub.group, sub.consumer)
+		sub.backend.mu.Lock()
+		delete(sub.backend.subs, sub)
+		sub.backend.mu.Unlock()
+	})
+
+	return nil
+}
+
+func redisStreamAddArgs(topic string, body []byte) []interface{} {
+	args := []interface{}{topic}
+	if RedisStreamMaxLen > 0 {
+		args = append(args, "MAXLEN", "~", RedisStreamMaxLen)
+	}
+
+	return append(args, "*", redisStreamBodyField, body)
+}
+
+// redisStreamGroupStart first entry id of a new group, the groups of dead-letter topics read
+// the entries written before them so a replay finds the existing dead letters
+func redisStreamGroupStart(topic string, ephemeral bool) string {
+	if !ephemeral && strings.HasSuffix(topic, DeadLetterSuffix) {
+		return "0"
+	}
+
+	return "$"
+}
+
+func redisStreamConsumerName(host string, n int) string {
+	return fmt.Sprintf("%v-%v", host, n)
+}
+
+func redisStreamConsumerKey(topic, group, name string) string {
+	return fmt.Sprintf("%v/%v/%v", topic, group, name)
+}
+
+// redisStreamNextID smallest entry id after id, the start of the next XPENDING page
+func redisStreamNextID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return id
+	}
+
+	return fmt.Sprintf("%v-%v", parts[0], seq+1)
+}
+
+// redisStreamOtherConsumer the first consumer of the group other than name, preferring the
+// ones with the least pending entries
+func redisStreamOtherConsumer(consumers []redisStreamConsumer, name string) string {
+	other := ""
+	var pending int64 = -1
+	for _, c := range consumers {
+		if c.Name == name {
+			continue
+		}
+		if pending < 0 || c.Pending < pending {
+			other, pending = c.Name, c.Pending
+		}
+	}
+
+	return other
+}
+
+// parseRedisStreamPending parse the [id, consumer, idle ms, deliveries] items of a XPENDING range reply
+func parseRedisStreamPending(reply []interface{}) []redisStreamPending {
+	var pending []redisStreamPending
+	for _, item := range reply {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) < 4 {
+			continue
+		}
+
+		p := redisStreamPending{}
+		p.ID, _ = redis.String(fields[0], nil)
+		p.Consumer, _ = redis.String(fields[1], nil)
+		p.Idle, _ = redis.Int64(fields[2], nil)
+		p.Deliveries, _ = redis.Int64(fields[3], nil)
+		pending = append(pending, p)
+	}
+
+	return pending
+}
+
+// parseRedisStreamConsumers parse a XINFO CONSUMERS reply, a list of field value lists
+func parseRedisStreamConsumers(reply []interface{}) []redisStreamConsumer {
+	var consumers []redisStreamConsumer
+	for _, item := range reply {
+		fields, err := redis.Values(item, nil)
+		if err != nil {
+			continue
+		}
+
+		c := redisStreamConsumer{}
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := redis.String(fields[i], nil)
+			switch key {
+			case "name":
+				c.Name, _ = redis.String(fields[i+1], nil)
+			case "pending":
+				c.Pending, _ = redis.Int64(fields[i+1], nil)
+			}
+		}
+		if c.Name != "" {
+			consumers = append(consumers, c)
+		}
+	}
+
+	return consumers
+}
+
+// parseRedisStreamRead parse a XREADGROUP reply of a single stream, nil when the read timed out
+func parseRedisStreamRead(reply interface{}) ([]redisStreamEntry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []redisStreamEntry
+	for _, stream := range streams {
+		// [stream name, entries]
+		fields, err := redis.Values(stream, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected stream reply %v", stream)
+		}
+
+		streamEntries, err := parseRedisStreamEntries(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntries...)
+	}
+
+	return entries, nil
+}
+
+// parseRedisStreamEntries parse a list of [id, [field, value...]] entries, an entry
+// without fields is returned Trimmed so it can be acked
+func parseRedisStreamEntries(reply interface{}) ([]redisStreamEntry, error) {
+	items, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []redisStreamEntry
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", item)
+		}
+
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		// entries deleted by trimming are claimed with nil fields
+		if fields[1] == nil {
+			entries = append(entries, redisStreamEntry{ID: id, Trimmed: true})
+			continue
+		}
+		values, err := redis.ByteSlices(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := redisStreamEntry{ID: id}
+		for i := 0; i+1 < len(values); i += 2 {
+			if string(values[i]) == redisStreamBodyField {
+				entry.Body = values[i+1]
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// redisStreamIDTime creation time of a stream entry, IDs are <unix ms>-<seq>
+func redisStreamIDTime(id string) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRedisStreamRead(t *testing.T) {
+	if entries, err := parseRedisStreamRead(nil); err != nil || entries != nil {
+		t.Errorf("timed out read: entries=%v err=%v", entries, err)
+	}
+
+	reply := []interface{}{
+		[]interface{}{
+			[]byte("events"),
+			[]interface{}{
+				[]interface{}{[]byte("1526919030474-0"), []interface{}{[]byte("body"), []byte("one")}},
+				// trimmed entry claimed without fields
+				[]interface{}{[]byte("1526919030474-1"), nil},
+				[]interface{}{[]byte("1526919030475-0"), []interface{}{[]byte("other"), []byte("x"), []byte("body"), []byte("two")}},
+			},
+		},
+	}
+
+	entries, err := parseRedisStreamRead(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("entries=%v, want 3", entries)
+	}
+	if entries[0].ID != "1526919030474-0" || string(entries[0].Body) != "one" || string(entries[2].Body) != "two" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if entries[0].Trimmed || !entries[1].Trimmed || entries[1].ID != "1526919030474-1" || entries[2].Trimmed {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	if ts := redisStreamIDTime("1526919030474-0"); !ts.Equal(time.Unix(1526919030, 474000000)) {
+		t.Errorf("redisStreamIDTime=%v", ts)
+	}
+}
+
+func TestRedisStreamGroupStart(t *testing.T) {
+	if start := redisStreamGroupStart("jobs", false); start != "$" {
+		t.Errorf("topic group start=%v, want $", start)
+	}
+	if start := redisStreamGroupStart(DeadLetterTopic("jobs"), false); start != "0" {
+		t.Errorf("dead-letter group start=%v, want 0", start)
+	}
+	if start := redisStreamGroupStart(DeadLetterTopic("jobs"), true); start != "$" {
+		t.Errorf("ephemeral dead-letter group start=%v, want $", start)
+	}
+}
+
+func TestRedisStreamPending(t *testing.T) {
+	pending := parseRedisStreamPending([]interface{}{
+		[]interface{}{[]byte("1526919030474-0"), []byte("host-1"), int64(31000), int64(2)},
+		[]interface{}{[]byte("1526919030474-1")},
+	})
+	if len(pending) != 1 || pending[0].ID != "1526919030474-0" || pending[0].Consumer != "host-1" || pending[0].Idle != 31000 || pending[0].Deliveries != 2 {
+		t.Errorf("unexpected pending %+v", pending)
+	}
+
+	if next := redisStreamNextID("1526919030474-9"); next != "1526919030474-10" {
+		t.Errorf("redisStreamNextID=%v", next)
+	}
+}
+
+func TestRedisStreamConsumers(t *testing.T) {
+	consumers := parseRedisStreamConsumers([]interface{}{
+		[]interface{}{[]byte("name"), []byte("host-1"), []byte("pending"), int64(3), []byte("idle"), int64(10)},
+		[]interface{}{[]byte("name"), []byte("host-2"), []byte("pending"), int64(5), []byte("idle"), int64(10)},
+		[]interface{}{[]byte("name"), []byte("other-1"), []byte("pending"), int64(1), []byte("idle"), int64(10)},
+	})
+	if len(consumers) != 3 {
+		t.Fatalf("consumers=%+v", consumers)
+	}
+	if other := redisStreamOtherConsumer(consumers, "other-1"); other != "host-1" {
+		t.Errorf("other consumer=%v, want the least pending host-1", other)
+	}
+	if other := redisStreamOtherConsumer(consumers[:1], "host-1"); other != "" {
+		t.Errorf("other consumer=%v, want none", other)
+	}
+}
+
+func TestRedisStreamConsumerNames(t *testing.T) {
+	b := &RedisStreamBackend{}
+	first := b.acquireConsumer("events", "workers")
+	second := b.acquireConsumer("events", "workers")
+	if first == second {
+		t.Fatalf("subscriptions of a group must have distinct consumers %v", first)
+	}
+	if other := b.acquireConsumer("events", "audit"); other != first {
+		t.Errorf("consumer of another group=%v, want %v", other, first)
+	}
+
+	// the name is reused after close, so a restart resumes the pending entries
+	b.releaseConsumer("events", "workers", first)
+	if again := b.acquireConsumer("events", "workers"); again != first {
+		t.Errorf("consumer after release=%v, want %v", again, first)
+	}
+}
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type (
+	// Backend messaging broker connection, one instance per connection
+	Backend interface {
+		// Connect connect to the broker with config
+		Connect(MSGBackendConfig) error
+		// Publish publish the body to topic
+		Publish(MSGBackendPubReq) error
+		// Subscribe consume topic on channel with the request handler
+		Subscribe(MSGBackendSubscReq) (Subscription, error)
+		// Close close the subscriptions and the broker connection
+		Close() error
+		// Health check the broker connection
+		Health() error
+	}
+
+	// MultiPublisher backend able to publish a batch of messages at once
+	MultiPublisher interface {
+		MultiPublish(topic string, bodies [][]byte) error
+	}
+
+	// BackendDriver registered messaging backend
+	BackendDriver struct {
+		// New create a new unconnected backend instance
+		New func() Backend
+		// RemoteConfig connection settings are loaded from configctl by SetAndInitBackend
+		RemoteConfig bool
+	}
+)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]BackendDriver{}
+)
+
+// Register register a backend driver by name, usually from the init of the backend file
+func Register(name string, driver BackendDriver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if driver.New == nil {
+		panic(fmt.Sprintf("messaging backend %v registered without New", name))
+	}
+	drivers[name] = driver
+}
+
+// GetDriver get a registered backend driver by name
+func GetDriver(name string) (BackendDriver, bool) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	driver, ok := drivers[name]
+	return driver, ok
+}
+
+// RegisteredBackends names of the registered backends
+func RegisteredBackends() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewBackend create a new unconnected instance of a registered backend
+func NewBackend(name string) (Backend, error) {
+	driver, ok := GetDriver(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown messaging backend %v, registered: %v", name, RegisteredBackends())
+	}
+
+	return driver.New(), nil
+}
+
+// Connect create and connect a new backend instance for config, independent from the current backend
+func Connect(confg MSGBackendConfig) (Backend, error) {
+	b, err := NewBackend(confg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Connect(confg); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
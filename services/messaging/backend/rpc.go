@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+)
+
+type (
+	// Requester backend supporting request/reply
+	Requester interface {
+		// Request publish body to topic and wait for the reply of a responder
+		Request(topic string, body []byte, timeout time.Duration) ([]byte, error)
+		// Respond answer the requests published to topic, responders sharing a channel split the requests
+		Respond(topic, channel string, handler ReplyHandler) (Subscription, error)
+	}
+
+	// ReplyHandler responder handler, the returned bytes or error are sent back to the requester
+	ReplyHandler func(*Message) ([]byte, error)
+
+	// rpcEnvelope request and reply wrapper carrying the correlation
+	rpcEnvelope struct {
+		CorrelationID string `json:"correlation_id"`
+		ReplyTo       string `json:"reply_to,omitempty"`
+		Body          []byte `json:"body"`
+		Error         string `json:"error,omitempty"`
+	}
+
+	// rpcEmulator request/reply over plain publish/subscribe: requests carry a correlation ID
+	// and the reply topic of the requester, which consumes its replies on a single subscription
+	rpcEmulator struct {
+		backend      Backend
+		replyTopic   string
+		replyChannel string
+
+		startOnce sync.Once
+		startErr  error
+
+		mu      sync.Mutex
+		pending map[string]chan rpcEnvelope
+	}
+)
+
+var (
+	// ErrRequestTimeout no reply received before the request timeout
+	ErrRequestTimeout = fmt.Errorf("messaging request timed out")
+)
+
+// Request send a request with b and wait for the reply
+func Request(b Backend, topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	requester, ok := b.(Requester)
+	if !ok {
+		return nil, fmt.Errorf("messaging backend does not support request/reply")
+	}
+
+	return requester.Request(topic, body, timeout)
+}
+
+// Respond answer the requests sent to topic with b
+func Respond(b Backend, topic, channel string, handler ReplyHandler) (Subscription, error) {
+	requester, ok := b.(Requester)
+	if !ok {
+		return nil, fmt.Errorf("messaging backend does not support request/reply")
+	}
+
+	return requester.Respond(topic, channel, handler)
+}
+
+func newRPCEmulator(b Backend, replyTopic, replyChannel string) *rpcEmulator {
+	return &rpcEmulator{
+		backend:      b,
+		replyTopic:   replyTopic,
+		replyChannel: replyChannel,
+		pending:      map[string]chan rpcEnvelope{},
+	}
+}
+
+// rpcReplyTopic unique reply topic name of a requester
+func rpcReplyTopic() string {
+	return fmt.Sprintf("rpc_reply_%v", utils.GenerateUUID())
+}
+
+// start subscribe to the reply topic on the first request
+func (rpc *rpcEmulator) start() error {
+	rpc.startOnce.Do(func() {
+		_, rpc.startErr = rpc.backend.Subscribe(MSGBackendSubscReq{
+			Topic:   rpc.replyTopic,
+			Channel: rpc.replyChannel,
+			Handler: rpc.handleReply,
+		})
+	})
+
+	return rpc.startErr
+}
+
+func (rpc *rpcEmulator) handleReply(msg *Message) error {
+	var reply rpcEnvelope
+	if err := json.Unmarshal(msg.Body, &reply); err != nil {
+		utils.Error(fmt.Sprintf("error rpc invalid reply topic=%v err=%v", msg.Topic, err))
+		return nil
+	}
+
+	rpc.mu.Lock()
+	ch, ok := rpc.pending[reply.CorrelationID]
+	rpc.mu.Unlock()
+
+	// late replies of timed out requests and redelivered replies are dropped
+	if ok {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+	return nil
+}
+
+func (rpc *rpcEmulator) request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	if err := rpc.start(); err != nil {
+		return nil, err
+	}
+
+	id := utils.GenerateUUID()
+	ch := make(chan rpcEnvelope, 1)
+	rpc.mu.Lock()
+	rpc.pending[id] = ch
+	rpc.mu.Unlock()
+	defer func() {
+		rpc.mu.Lock()
+		delete(rpc.pending, id)
+		rpc.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(rpcEnvelope{CorrelationID: id, ReplyTo: rpc.replyTopic, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	if err := rpc.backend.Publish(MSGBackendPubReq{Topic: topic, Body: data}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return replyResult(reply)
+	case <-time.After(timeout):
+		return nil, ErrRequestTimeout
+	}
+}
+
+func (rpc *rpcEmulator) respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	return rpc.backend.Subscribe(MSGBackendSubscReq{
+		Topic:   topic,
+		Channel: channel,
+		Handler: func(msg *Message) error {
+			var req rpcEnvelope
+			if err := json.Unmarshal(msg.Body, &req); err != nil || req.ReplyTo == "" {
+				utils.Error(fmt.Sprintf("error rpc invalid request topic=%v err=%v", topic, err))
+				return nil
+			}
+
+			reqMsg := *msg
+			reqMsg.Body = req.Body
+			data, err := json.Marshal(replyEnvelope(req.CorrelationID, handler, &reqMsg))
+			if err != nil {
+				return err
+			}
+
+			return rpc.backend.Publish(MSGBackendPubReq{Topic: req.ReplyTo, Body: data})
+		},
+	})
+}
+
+// replyEnvelope run the handler and wrap its result for the requester
+func replyEnvelope(correlationID string, handler ReplyHandler, msg *Message) rpcEnvelope {
+	reply := rpcEnvelope{CorrelationID: correlationID}
+
+	body, err := handler(msg)
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	reply.Body = body
+	return reply
+}
+
+func replyResult(reply rpcEnvelope) ([]byte, error) {
+	if reply.Error != "" {
+		return nil, fmt.Errorf("messaging request failed: %v", reply.Error)
+	}
+
+	return reply.Body, nil
+}
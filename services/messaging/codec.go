@@ -0,0 +1,94 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// ContentTypeJSON content type of the json codec
+	ContentTypeJSON = "application/json"
+	// ContentTypeProtobuf content type of the protobuf codec
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+type (
+	// Codec marshal and unmarshal envelope bodies of a content type
+	Codec interface {
+		ContentType() string
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// JSONCodec encoding/json codec, the default codec
+	JSONCodec struct{}
+
+	// ProtobufCodec protobuf codec, values must be proto.Message
+	ProtobufCodec struct{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtobufCodec{})
+}
+
+// RegisterCodec register a codec by its content type
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+// GetCodec get the codec of a content type
+func GetCodec(contentType string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no messaging codec for content type %q", contentType)
+	}
+
+	return codec, nil
+}
+
+// ContentType application/json
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+// Marshal json marshal v
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal json unmarshal data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// ContentType application/x-protobuf
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+// Marshal protobuf marshal v
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec requires a proto.Message, got %T", v)
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal protobuf unmarshal data into v
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec requires a proto.Message, got %T", v)
+	}
+
+	return proto.Unmarshal(data, m)
+}
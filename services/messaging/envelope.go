@@ -0,0 +1,203 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/b-eee/amagi/services/messaging/backend"
+
+	utils "github.com/b-eee/amagi"
+)
+
+type (
+	// Envelope message metadata and encoded body, published as the json of the envelope
+	Envelope struct {
+		ID            string            `json:"id"`
+		Timestamp     time.Time         `json:"timestamp"`
+		ContentType   string            `json:"content_type"`
+		SchemaVersion string            `json:"schema_version,omitempty"`
+		CorrelationID string            `json:"correlation_id,omitempty"`
+		TraceID       string            `json:"trace_id,omitempty"`
+		Headers       map[string]string `json:"headers,omitempty"`
+		Body          []byte            `json:"body"`
+	}
+
+	// PublishValueReq publish request of a Go value, Codec defaults to JSONCodec
+	PublishValueReq struct {
+		Topic         string
+		Value         interface{}
+		Codec         Codec
+		SchemaVersion string
+		CorrelationID string
+		TraceID       string
+		Headers       map[string]string
+	}
+
+	// EnvelopeHandler subscription handler receiving the decoded envelope, returning an error requeues the message
+	EnvelopeHandler func(*Envelope) error
+
+	// SubscribeEnvelopeReq subscribe request for messages published with PublishValue,
+	// Redelivery and Middlewares as in SubscribeReq
+	SubscribeEnvelopeReq struct {
+		Topic       string
+		Channel     string
+		Handler     EnvelopeHandler
+		Concurrency int
+		Redelivery  *RedeliveryPolicy
+		Middlewares []Middleware
+	}
+
+	// ValueHandler subscription handler receiving the envelope and a pointer to its decoded
+	// body, returning an error requeues the message
+	ValueHandler func(env *Envelope, v interface{}) error
+
+	// SubscribeValueReq subscribe request decoding the body of every envelope into a new
+	// value of the type of Value, e.g. Order{} or &Order{}, before calling Handler
+	SubscribeValueReq struct {
+		Topic       string
+		Channel     string
+		Value       interface{}
+		Handler     ValueHandler
+		Concurrency int
+		Redelivery  *RedeliveryPolicy
+		Middlewares []Middleware
+	}
+)
+
+// NewEnvelope marshal v with codec into a new envelope
+func NewEnvelope(v interface{}, codec Codec) (*Envelope, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("envelope marshal %T: %v", v, err)
+	}
+
+	return &Envelope{
+		ID:          utils.GenerateUUID(),
+		Timestamp:   time.Now().UTC(),
+		ContentType: codec.ContentType(),
+		Body:        body,
+	}, nil
+}
+
+// DecodeEnvelope parse a published envelope, bodies not published as an envelope
+// are returned as the json body of an envelope without ID
+func DecodeEnvelope(data []byte) *Envelope {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.ID == "" || env.ContentType == "" {
+		return &Envelope{ContentType: ContentTypeJSON, Body: data}
+	}
+
+	return &env
+}
+
+// Encode json of the envelope as published
+func (env *Envelope) Encode() ([]byte, error) {
+	return json.Marshal(env)
+}
+
+// Decode unmarshal the body into v with the codec of the envelope content type
+func (env *Envelope) Decode(v interface{}) error {
+	codec, err := GetCodec(env.ContentType)
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(env.Body, v)
+}
+
+// Header get a header value
+func (env *Envelope) Header(key string) string {
+	return env.Headers[key]
+}
+
+// SetHeader set a header value
+func (env *Envelope) SetHeader(key, value string) {
+	if env.Headers == nil {
+		env.Headers = map[string]string{}
+	}
+	env.Headers[key] = value
+}
+
+// PublishEnvelope publish env to topic
+func (msg *BackendConfig) PublishEnvelope(topic string, env *Envelope) error {
+	data, err := env.Encode()
+	if err != nil {
+		return err
+	}
+
+	return msg.Publish(PublishReq{Topic: topic, Body: data})
+}
+
+// PublishValue marshal req.Value into an envelope and publish it
+func (msg *BackendConfig) PublishValue(req PublishValueReq) error {
+	env, err := NewEnvelope(req.Value, req.Codec)
+	if err != nil {
+		return err
+	}
+	env.SchemaVersion = req.SchemaVersion
+	env.CorrelationID = req.CorrelationID
+	env.TraceID = req.TraceID
+	env.Headers = req.Headers
+
+	return msg.PublishEnvelope(req.Topic, env)
+}
+
+// SubscribeEnvelope subscribe with a handler receiving decoded envelopes, use Envelope.Decode for the value
+func (msg *BackendConfig) SubscribeEnvelope(req SubscribeEnvelopeReq) (Subscription, error) {
+	if req.Handler == nil {
+		return nil, fmt.Errorf("subscribe request requires topic and handler")
+	}
+
+	return msg.Subscribe(SubscribeReq{
+		Topic:       req.Topic,
+		Channel:     req.Channel,
+		Concurrency: req.Concurrency,
+		Redelivery:  req.Redelivery,
+		Middlewares: req.Middlewares,
+		Handler: func(m *Message) error {
+			return req.Handler(DecodeEnvelope(m.Body))
+		},
+	})
+}
+
+// SubscribeValue subscribe with a handler receiving the envelope body decoded into a new
+// value of the type of req.Value. Bodies that can't be decoded are dead-lettered when the
+// subscription has a Redelivery policy and dropped otherwise
+func (msg *BackendConfig) SubscribeValue(req SubscribeValueReq) (Subscription, error) {
+	if req.Handler == nil || req.Value == nil {
+		return nil, fmt.Errorf("subscribe value request requires topic, value and handler")
+	}
+
+	t := reflect.TypeOf(req.Value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return msg.SubscribeEnvelope(SubscribeEnvelopeReq{
+		Topic:       req.Topic,
+		Channel:     req.Channel,
+		Concurrency: req.Concurrency,
+		Redelivery:  req.Redelivery,
+		Middlewares: req.Middlewares,
+		Handler: func(env *Envelope) error {
+			v := reflect.New(t).Interface()
+			if err := env.Decode(v); err != nil {
+				err = fmt.Errorf("envelope decode %T: %v", v, err)
+				if req.Redelivery != nil {
+					return backend.Permanent(err)
+				}
+
+				utils.Error(fmt.Sprintf("undecodable message dropped topic=%v id=%v: %v", req.Topic, env.ID, err))
+				return nil
+			}
+
+			return req.Handler(env, v)
+		},
+	})
+}
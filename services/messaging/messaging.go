@@ -2,6 +2,7 @@ package messaging
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/b-eee/amagi/services/messaging/backend"
 
@@ -14,17 +15,47 @@ var (
 )
 
 type (
-	// BackendConfig backend config
+	// BackendConfig backend config, Backend is the connected instance for
+	// configs created by NewMessaging and the current backend otherwise.
+	// Middlewares wrap the handler of every subscription, see Use. With Schemas set the
+	// messages of topics with a schema are validated on publish and on consume
 	BackendConfig struct {
-		ConfigEnv backend.MSGBackendConfig
+		ConfigEnv   backend.MSGBackendConfig
+		Backend     backend.Backend
+		Middlewares []Middleware
+		Schemas     *SchemaRegistry
 	}
 
-	// SubscribeReq subscribe request
+	// SubscribeReq subscribe request, Handler is called for every message consumed on Channel
+	// through the global then the request Middlewares. With Redelivery set, failing messages
+	// are retried with backoff then dead-lettered, not supported on core nats (at most once)
 	SubscribeReq struct {
-		Topic   string
-		Channel string
+		Topic       string
+		Channel     string
+		Handler     MessageHandler
+		Concurrency int
+		Redelivery  *RedeliveryPolicy
+		Middlewares []Middleware
 	}
 
+	// Message consumed message
+	Message = backend.Message
+
+	// MessageHandler subscription handler, returning an error requeues the message
+	MessageHandler = backend.MessageHandler
+
+	// Subscription handle of an active subscription
+	Subscription = backend.Subscription
+
+	// RedeliveryPolicy max attempts and backoff of failing messages
+	RedeliveryPolicy = backend.RedeliveryPolicy
+
+	// DeadLetter message published to <topic>.dead once out of attempts
+	DeadLetter = backend.DeadLetter
+
+	// ReplyHandler responder handler, the returned bytes or error are sent back to the requester
+	ReplyHandler = backend.ReplyHandler
+
 	// PublishReq publish request to backend
 	PublishReq struct {
 		Topic string
@@ -45,6 +76,17 @@ func InitMessaging() *BackendConfig {
 	return &backend
 }
 
+// NewMessaging connect a new backend instance independent from the current backend,
+// allowing multiple brokers in one process
+func NewMessaging(config backend.MSGBackendConfig) (*BackendConfig, error) {
+	b, err := backend.Connect(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackendConfig{ConfigEnv: config, Backend: b}, nil
+}
+
 // SetCurrentMSGBackend set current messaging backend and return MSGBackendConfig
 func SetCurrentMSGBackend(config backend.MSGBackendConfig) BackendConfig {
 	newBackend := BackendConfig{
@@ -60,21 +102,68 @@ func GetCurrentMSGBackend() BackendConfig {
 	return CurrentMSGBackend
 }
 
-// Subscribe subscribe request to messaging
-func (msg *BackendConfig) Subscribe(req SubscribeReq) error {
-	var r backend.MSGBackendSubscReq
+// Subscribe subscribe request to messaging, close the returned subscription to stop consuming
+func (msg *BackendConfig) Subscribe(req SubscribeReq) (Subscription, error) {
+	if len(req.Topic) == 0 || req.Handler == nil {
+		return nil, fmt.Errorf("subscribe request requires topic and handler")
+	}
 
-	if len(req.Topic) != 0 && len(req.Channel) != 0 {
-		r.Topic = req.Topic
-		r.Channel = req.Channel
+	b, err := msg.backend()
+	if err != nil {
+		return nil, err
+	}
+	if req.Redelivery != nil && !backend.Redelivers(b) {
+		return nil, backend.ErrRedeliveryUnsupported
 	}
 
-	utils.Info(fmt.Sprintf("subscribing to chan=%v topic=%v", r.Topic, r.Channel))
-	if err := backend.SubscribeToBackend(GetCurrentMSGBackend().ConfigEnv, r); err != nil {
-		return err
+	middlewares := append(append([]Middleware{}, msg.Middlewares...), req.Middlewares...)
+	if msg.Schemas != nil {
+		// looked up per message so schemas registered after subscribing apply.
+		// dead-lettered when the subscription can, dropped otherwise
+		middlewares = append(middlewares, ValidateSchema(msg.Schemas, req.Redelivery != nil))
+	}
+	r := backend.MSGBackendSubscReq{
+		Topic:       req.Topic,
+		Channel:     req.Channel,
+		Handler:     Chain(req.Handler, middlewares...),
+		Concurrency: req.Concurrency,
+	}
+	if req.Redelivery != nil {
+		r.Handler = backend.WithRedelivery(b, *req.Redelivery, r.Handler)
 	}
 
-	return nil
+	utils.Info(fmt.Sprintf("subscribing to topic=%v chan=%v", r.Topic, r.Channel))
+	return b.Subscribe(r)
+}
+
+// ReplayDeadLetters republish up to max dead-lettered messages of topic to topic,
+// returns once no dead letter arrived for idle. Not supported on core nats
+func (msg *BackendConfig) ReplayDeadLetters(topic string, max int, idle time.Duration) (int, error) {
+	b, err := msg.backend()
+	if err != nil {
+		return 0, err
+	}
+
+	return backend.ReplayDeadLetters(b, topic, max, idle)
+}
+
+// backend connected instance of msg, the current backend when msg has none
+func (msg *BackendConfig) backend() (backend.Backend, error) {
+	if msg.Backend != nil {
+		return msg.Backend, nil
+	}
+
+	b := backend.GetBackend()
+	if b == nil {
+		return nil, fmt.Errorf("messaging backend %v is not connected", GetCurrentMSGBackend().ConfigEnv.Backend)
+	}
+
+	return b, nil
+}
+
+// RequeueAfter return a handler error requeueing the message after delay
+func RequeueAfter(delay time.Duration, err error) error {
+	return backend.RequeueAfter(delay, err)
 }
 
 // Publish Publish request to messaging
@@ -86,9 +175,82 @@ func (msg *BackendConfig) Publish(req PublishReq) error {
 		r.Body = req.Body
 	}
 
+	if msg.Schemas != nil {
+		if err := msg.Schemas.Validate(r.Topic, r.Body); err != nil {
+			utils.Error(fmt.Sprintf("error Publish %v", err))
+			return err
+		}
+	}
+
+	if msg.Backend != nil {
+		return msg.Backend.Publish(r)
+	}
+
 	if err := backend.PublishToBackend(GetCurrentMSGBackend().ConfigEnv, r); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// MultiPublish publish a batch of bodies to topic
+func (msg *BackendConfig) MultiPublish(topic string, bodies [][]byte) error {
+	if len(topic) == 0 || len(bodies) == 0 {
+		return fmt.Errorf("multi publish requires topic and bodies")
+	}
+
+	if msg.Schemas != nil {
+		for _, body := range bodies {
+			if err := msg.Schemas.Validate(topic, body); err != nil {
+				utils.Error(fmt.Sprintf("error MultiPublish %v", err))
+				return err
+			}
+		}
+	}
+
+	if msg.Backend != nil {
+		return backend.MultiPublish(msg.Backend, topic, bodies)
+	}
+
+	return backend.MultiPublishToBackend(GetCurrentMSGBackend().ConfigEnv, topic, bodies)
+}
+
+// Request publish body to topic and wait up to timeout for the reply of a responder
+func (msg *BackendConfig) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	if msg.Backend != nil {
+		return backend.Request(msg.Backend, topic, body, timeout)
+	}
+
+	return backend.RequestToBackend(GetCurrentMSGBackend().ConfigEnv, topic, body, timeout)
+}
+
+// Respond answer the requests sent to topic, responders sharing a channel split the requests
+func (msg *BackendConfig) Respond(topic, channel string, handler ReplyHandler) (Subscription, error) {
+	if len(topic) == 0 || handler == nil {
+		return nil, fmt.Errorf("respond requires topic and handler")
+	}
+
+	if msg.Backend != nil {
+		return backend.Respond(msg.Backend, topic, channel, handler)
+	}
+
+	return backend.RespondOnBackend(GetCurrentMSGBackend().ConfigEnv, topic, channel, handler)
+}
+
+// Health check the messaging backend connection
+func (msg *BackendConfig) Health() error {
+	if msg.Backend != nil {
+		return msg.Backend.Health()
+	}
+
+	return backend.BackendHealth()
+}
+
+// Close close the messaging backend and its subscriptions
+func (msg *BackendConfig) Close() error {
+	if msg.Backend != nil {
+		return msg.Backend.Close()
+	}
+
+	return backend.CloseBackend()
+}
@@ -2,8 +2,11 @@ package messaging
 
 import (
 	"os"
+	"sync/atomic"
 	"testing"
-	// "github.com/b-eee/amagi/services/messaging/backend"
+	"time"
+
+	"github.com/b-eee/amagi/services/messaging/backend"
 )
 
 // go test -v -run=TestInitMessaging ./services/messaging
@@ -22,3 +25,193 @@ func TestInitMessaging(t *testing.T) {
 	// 	t.Error(err)
 	// }
 }
+
+// go test -v -run=TestMemoryMessaging ./services/messaging
+func TestMemoryMessaging(t *testing.T) {
+	os.Setenv("MESSAGING_BACKEND", "memory")
+
+	b := InitMessaging()
+	defer b.Close()
+
+	received := make(chan []byte, 1)
+	sub, err := b.Subscribe(SubscribeReq{
+		Topic:   "test",
+		Channel: "test_channel",
+		Handler: func(msg *Message) error {
+			received <- msg.Body
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := b.Publish(PublishReq{Topic: "test", Body: []byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-received:
+		if string(body) != "test" {
+			t.Errorf("received %q, want test", body)
+		}
+	case <-time.After(time.Second):
+		t.Error("message not received")
+	}
+}
+
+// go test -v -run=TestPublishValue ./services/messaging
+func TestPublishValue(t *testing.T) {
+	b, err := NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	type order struct {
+		ID    string `json:"id"`
+		Total int    `json:"total"`
+	}
+
+	received := make(chan *Envelope, 2)
+	if _, err := b.SubscribeEnvelope(SubscribeEnvelopeReq{
+		Topic:   "orders",
+		Channel: "test",
+		Handler: func(env *Envelope) error {
+			received <- env
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PublishValue(PublishValueReq{
+		Topic:         "orders",
+		Value:         order{ID: "o1", Total: 3},
+		SchemaVersion: "1",
+		CorrelationID: "c1",
+		Headers:       map[string]string{"tenant": "t1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// raw publishes are received as a json envelope without ID
+	if err := b.Publish(PublishReq{Topic: "orders", Body: []byte(`{"id":"o2"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"o1", "o2"} {
+		select {
+		case env := <-received:
+			var o order
+			if err := env.Decode(&o); err != nil {
+				t.Fatal(err)
+			}
+			if o.ID != want {
+				t.Errorf("decoded %+v, want id %v", o, want)
+			}
+			if want == "o1" && (env.ID == "" || env.CorrelationID != "c1" || env.Header("tenant") != "t1" || env.ContentType != ContentTypeJSON) {
+				t.Errorf("envelope metadata not kept %+v", env)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	if _, err := GetBytes(make(chan int)); err == nil {
+		t.Error("GetBytes must return the marshal error")
+	}
+}
+
+// go test -v -run=TestSubscribeValue ./services/messaging
+func TestSubscribeValue(t *testing.T) {
+	b, err := NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	type order struct {
+		ID    string `json:"id"`
+		Total int    `json:"total"`
+	}
+
+	var wrapped int32
+	received := make(chan *order, 1)
+	if _, err := b.SubscribeValue(SubscribeValueReq{
+		Topic:      "orders",
+		Channel:    "test",
+		Value:      order{},
+		Redelivery: &RedeliveryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond},
+		Middlewares: []Middleware{func(next MessageHandler) MessageHandler {
+			return func(m *Message) error {
+				atomic.AddInt32(&wrapped, 1)
+				return next(m)
+			}
+		}},
+		Handler: func(env *Envelope, v interface{}) error {
+			received <- v.(*order)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dead := make(chan *Message, 1)
+	b.Subscribe(SubscribeReq{Topic: "orders.dead", Channel: "test", Handler: func(m *Message) error {
+		dead <- m
+		return nil
+	}})
+
+	if err := b.PublishValue(PublishValueReq{Topic: "orders", Value: order{ID: "o1", Total: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case o := <-received:
+		if o.ID != "o1" || o.Total != 3 {
+			t.Errorf("decoded %+v", o)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	if atomic.LoadInt32(&wrapped) != 1 {
+		t.Errorf("middleware called %v times, want 1", atomic.LoadInt32(&wrapped))
+	}
+
+	// not an order, dead-lettered without retries
+	if err := b.PublishValue(PublishValueReq{Topic: "orders", Value: map[string]interface{}{"id": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dead:
+	case o := <-received:
+		t.Errorf("undecodable message handled %+v", o)
+	case <-time.After(time.Second):
+		t.Fatal("undecodable message not dead-lettered")
+	}
+
+	if _, err := b.SubscribeValue(SubscribeValueReq{Topic: "orders", Handler: func(*Envelope, interface{}) error { return nil }}); err == nil {
+		t.Error("a request without Value must be rejected")
+	}
+}
+
+// atMostOnceBackend memory backend reporting no redelivery, like core nats
+type atMostOnceBackend struct {
+	*backend.MemoryBackend
+}
+
+func (atMostOnceBackend) Redelivers() bool { return false }
+
+func TestSubscribeRedeliveryUnsupported(t *testing.T) {
+	b := &BackendConfig{Backend: atMostOnceBackend{backend.NewMemoryBackend()}}
+	defer b.Backend.Close()
+
+	_, err := b.Subscribe(SubscribeReq{
+		Topic:      "jobs",
+		Channel:    "workers",
+		Redelivery: &RedeliveryPolicy{MaxAttempts: 3},
+		Handler:    func(m *Message) error { return nil },
+	})
+	if err != backend.ErrRedeliveryUnsupported {
+		t.Errorf("err=%v, want ErrRedeliveryUnsupported", err)
+	}
+}
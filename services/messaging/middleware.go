@@ -0,0 +1,238 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/services/database"
+)
+
+type (
+	// Middleware wrap a subscription handler, like a gin middleware it runs code
+	// before and after the next handler and may stop the chain by not calling it
+	Middleware func(next MessageHandler) MessageHandler
+
+	// MetricsRecorder receive the outcome of every handled message
+	MetricsRecorder func(topic, channel string, duration time.Duration, err error)
+
+	// DedupStore remember the handled message keys for Dedup
+	DedupStore interface {
+		// Mark mark key as seen for ttl, false when it was already marked
+		Mark(key string, ttl time.Duration) (bool, error)
+		// Unmark forget key, the message failed and is handled again
+		Unmark(key string) error
+	}
+
+	// MemoryDedupStore in-process DedupStore
+	MemoryDedupStore struct {
+		mu        sync.Mutex
+		keys      map[string]time.Time
+		lastSweep time.Time
+	}
+
+	// RedisDedupStore DedupStore on database.RedisPool shared by all the consumers
+	RedisDedupStore struct {
+		Prefix string
+	}
+
+	traceIDKey struct{}
+)
+
+// Chain wrap handler with the middlewares, the first middleware is the outermost
+func Chain(handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Use add global middlewares applied to every subscription of msg, before the ones of the subscription
+func (msg *BackendConfig) Use(middlewares ...Middleware) *BackendConfig {
+	msg.Middlewares = append(msg.Middlewares, middlewares...)
+
+	return msg
+}
+
+// Recovery turn a handler panic into an error, requeueing the message
+func Recovery() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					utils.Error(fmt.Sprintf("panic in handler topic=%v chan=%v: %v\n%s", m.Topic, m.Channel, r, debug.Stack()))
+					err = fmt.Errorf("handler panic: %v", r)
+				}
+			}()
+
+			return next(m)
+		}
+	}
+}
+
+// Logging log every handled message with its duration and error
+func Logging() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) error {
+			s := time.Now()
+			err := next(m)
+			if err != nil {
+				utils.Error(fmt.Sprintf("message failed topic=%v chan=%v id=%v attempts=%v took: %v err=%v", m.Topic, m.Channel, m.ID, m.Attempts, time.Since(s), err))
+				return err
+			}
+
+			utils.Info(fmt.Sprintf("message handled topic=%v chan=%v id=%v attempts=%v took: %v", m.Topic, m.Channel, m.ID, m.Attempts, time.Since(s)))
+			return nil
+		}
+	}
+}
+
+// Metrics report the duration and outcome of every handled message to recorder
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) error {
+			s := time.Now()
+			err := next(m)
+			recorder(m.Topic, m.Channel, time.Since(s), err)
+
+			return err
+		}
+	}
+}
+
+// Tracing put the trace ID of the message envelope, or its correlation ID, in the message context
+func Tracing() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) error {
+			env := DecodeEnvelope(m.Body)
+			traceID := env.TraceID
+			if traceID == "" {
+				traceID = env.CorrelationID
+			}
+			if traceID != "" {
+				m.WithContext(ContextWithTraceID(m.Context(), traceID))
+			}
+
+			return next(m)
+		}
+	}
+}
+
+// ContextWithTraceID context carrying traceID
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext trace ID set by Tracing, empty when none
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// Dedup skip the messages already handled within ttl, keyed by envelope ID or broker message ID.
+// The key is released when the handler fails so the redelivery is handled
+func Dedup(store DedupStore, ttl time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) error {
+			key := dedupKey(m)
+			if key == "" {
+				return next(m)
+			}
+
+			first, err := store.Mark(key, ttl)
+			if err != nil {
+				// without the store handling twice beats losing the message
+				utils.Error(fmt.Sprintf("error dedup mark key=%v err=%v", key, err))
+				return next(m)
+			}
+			if !first {
+				utils.Info(fmt.Sprintf("duplicate message skipped topic=%v chan=%v key=%v", m.Topic, m.Channel, key))
+				return nil
+			}
+
+			if err := next(m); err != nil {
+				if uerr := store.Unmark(key); uerr != nil {
+					utils.Error(fmt.Sprintf("error dedup unmark key=%v err=%v", key, uerr))
+				}
+				return err
+			}
+
+			return nil
+		}
+	}
+}
+
+func dedupKey(m *Message) string {
+	id := m.ID
+	if env := DecodeEnvelope(m.Body); env.ID != "" {
+		id = env.ID
+	}
+	if id == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%v:%v:%v", m.Topic, m.Channel, id)
+}
+
+// NewMemoryDedupStore empty in-process dedup store
+func NewMemoryDedupStore() *MemoryDedupStore {
+	return &MemoryDedupStore{keys: map[string]time.Time{}}
+}
+
+// Mark mark key until ttl, expired keys are dropped once a minute
+func (store *MemoryDedupStore) Mark(key string, ttl time.Duration) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastSweep) > time.Minute {
+		for k, expires := range store.keys {
+			if now.After(expires) {
+				delete(store.keys, k)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	if expires, ok := store.keys[key]; ok && !now.After(expires) {
+		return false, nil
+	}
+	store.keys[key] = now.Add(ttl)
+
+	return true, nil
+}
+
+// Unmark forget key
+func (store *MemoryDedupStore) Unmark(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.keys, key)
+	return nil
+}
+
+// Mark SET NX the key with ttl
+func (store RedisDedupStore) Mark(key string, ttl time.Duration) (bool, error) {
+	conn := database.GetRedisConn()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", store.Prefix+key, 1, "NX", "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Unmark delete the key
+func (store RedisDedupStore) Unmark(key string) error {
+	conn := database.GetRedisConn()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", store.Prefix+key)
+	return err
+}
@@ -0,0 +1,106 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/b-eee/amagi/services/messaging/backend"
+)
+
+// go test -v -run=TestMiddlewareChain ./services/messaging
+func TestMiddlewareChain(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(m *Message) error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return next(m)
+			}
+		}
+	}
+
+	b, err := NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Use(record("global"), Tracing())
+
+	received := make(chan string, 1)
+	if _, err := b.Subscribe(SubscribeReq{
+		Topic:       "events",
+		Channel:     "test",
+		Middlewares: []Middleware{record("subscription")},
+		Handler: func(m *Message) error {
+			received <- TraceIDFromContext(m.Context())
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PublishValue(PublishValueReq{Topic: "events", Value: "x", TraceID: "trace-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case traceID := <-received:
+		if traceID != "trace-1" {
+			t.Errorf("trace id=%q, want trace-1", traceID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(order, ",") != "global,subscription" {
+		t.Errorf("middleware order=%v", order)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := Chain(func(m *Message) error {
+		panic("boom")
+	}, Recovery())
+
+	if err := handler(&Message{Topic: "events"}); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected the panic as error, got %v", err)
+	}
+}
+
+func TestDedupMiddleware(t *testing.T) {
+	var calls int
+	fail := true
+	handler := Chain(func(m *Message) error {
+		calls++
+		if fail {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	}, Dedup(NewMemoryDedupStore(), time.Minute))
+
+	msg := &Message{ID: "1", Topic: "events", Channel: "test", Body: []byte("x")}
+	// a failed message is handled again on redelivery
+	if err := handler(msg); err == nil {
+		t.Fatal("expected the handler error")
+	}
+	fail = false
+	for i := 0; i < 2; i++ {
+		if err := handler(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("calls=%v, want 2", calls)
+	}
+}
@@ -0,0 +1,310 @@
+package notifications
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/helpers"
+	"github.com/b-eee/amagi/services/database"
+	"github.com/b-eee/amagi/services/messaging/realtime"
+)
+
+type (
+	// Notification notification stored in the inbox of its recipient, EventID is the ID of
+	// the realtime event so clients can tell the delivered notifications apart
+	Notification struct {
+		ID        bson.ObjectId `bson:"_id" json:"id"`
+		Recipient string        `bson:"recipient" json:"recipient"`
+		EventID   string        `bson:"event_id" json:"event_id"`
+		Channel   string        `bson:"channel" json:"channel"`
+		Event     string        `bson:"event" json:"event"`
+		Message   interface{}   `bson:"message" json:"message"`
+		Read      bool          `bson:"read" json:"read"`
+		ReadAt    *time.Time    `bson:"read_at,omitempty" json:"read_at,omitempty"`
+		CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+	}
+
+	// InboxQuery list filter, Before is an event ID to page back from
+	InboxQuery struct {
+		UnreadOnly bool
+		Before     string
+		Limit      int
+	}
+
+	// RecipientFunc recipient of an inbox request, usually the user of the session
+	RecipientFunc func(c *gin.Context) (string, error)
+
+	markReadReq struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+)
+
+var (
+	// InboxCollection collection of the stored notifications
+	InboxCollection = "notification_inbox"
+
+	// DefaultInboxLimit page size of ListInbox
+	DefaultInboxLimit = 50
+
+	// MaxInboxLimit largest page size of ListInbox
+	MaxInboxLimit = 500
+)
+
+// EnsureInboxIndexes create the indexes of InboxCollection
+func EnsureInboxIndexes() error {
+	for _, key := range [][]string{{"recipient", "-event_id"}, {"recipient", "read"}} {
+		if err := database.MongoEnsureIndex(InboxCollection, mgo.Index{Key: key, Background: true}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Notify store the notification in the inbox of recipient then publish it, an offline
+// recipient gets it from the inbox on reconnect
+func Notify(recipient string, message interface{}, channel, event string) (Notification, error) {
+	e, err := realtime.NewEvent(channel, event, message)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	n := Notification{
+		ID:        bson.NewObjectId(),
+		Recipient: recipient,
+		EventID:   e.ID,
+		Channel:   channel,
+		Event:     event,
+		Message:   message,
+		CreatedAt: e.Timestamp,
+	}
+	if err := database.MongoInsert(InboxCollection, n); err != nil {
+		return n, err
+	}
+
+	if Realtime != nil {
+		err = realtime.PublishEvent(Realtime, RealtimeTopic, e)
+	} else {
+		err = Publish(message, channel, event)
+	}
+	if err != nil {
+		// stored, delivered on reconnect
+		utils.Error(fmt.Sprintf("error Notify publish recipient=%v: %v", recipient, err))
+	}
+
+	return n, nil
+}
+
+// ListInbox notifications of recipient, newest first
+func ListInbox(recipient string, query InboxQuery) ([]Notification, error) {
+	conn := database.BeginMongoWCol()(InboxCollection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"recipient": recipient}
+	if query.UnreadOnly {
+		selector["read"] = false
+	}
+	if query.Before != "" {
+		selector["event_id"] = bson.M{"$lt": query.Before}
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultInboxLimit
+	}
+	if limit > MaxInboxLimit {
+		limit = MaxInboxLimit
+	}
+
+	notifications := []Notification{}
+	err := conn.Col.Find(selector).Sort("-event_id").Limit(limit).All(&notifications)
+	conn.Record("listInbox", selector, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error ListInbox recipient=%v: %v", recipient, err))
+		return nil, err
+	}
+
+	utils.Info(fmt.Sprintf("ListInbox took: %v recipient=%v len(%v)", time.Since(conn.Time), recipient, len(notifications)))
+	return notifications, nil
+}
+
+// UnreadCount number of unread notifications of recipient
+func UnreadCount(recipient string) (int, error) {
+	conn := database.BeginMongoWCol()(InboxCollection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"recipient": recipient, "read": false}
+	count, err := conn.Col.Find(selector).Count()
+	conn.Record("unreadCount", selector, err)
+	return count, err
+}
+
+// MarkRead mark notifications of recipient as read, returns the number updated
+func MarkRead(recipient string, ids ...string) (int, error) {
+	var objectIDs []bson.ObjectId
+	for _, id := range ids {
+		if !bson.IsObjectIdHex(id) {
+			return 0, fmt.Errorf("invalid notification id %v", id)
+		}
+		objectIDs = append(objectIDs, bson.ObjectIdHex(id))
+	}
+	if len(objectIDs) == 0 {
+		return 0, nil
+	}
+
+	return markRead(bson.M{"recipient": recipient, "_id": bson.M{"$in": objectIDs}, "read": false})
+}
+
+// MarkAllRead mark every notification of recipient as read
+func MarkAllRead(recipient string) (int, error) {
+	return markRead(bson.M{"recipient": recipient, "read": false})
+}
+
+func markRead(selector bson.M) (int, error) {
+	conn := database.BeginMongoWCol()(InboxCollection)
+	defer conn.Conn.Close()
+
+	info, err := conn.Col.UpdateAll(selector, bson.M{"$set": bson.M{"read": true, "read_at": time.Now()}})
+	conn.Record("markRead", selector, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error MarkRead %v", err))
+		return 0, err
+	}
+
+	return info.Updated, nil
+}
+
+// PendingEvents unread notifications of recipient newer than lastEventID as realtime
+// events, all the unread ones up to MaxInboxLimit without lastEventID
+func PendingEvents(recipient, lastEventID string) ([]*realtime.Event, error) {
+	conn := database.BeginMongoWCol()(InboxCollection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"recipient": recipient, "read": false}
+	if lastEventID != "" {
+		selector["event_id"] = bson.M{"$gt": lastEventID}
+	}
+
+	var notifications []Notification
+	err := conn.Col.Find(selector).Sort("event_id").Limit(MaxInboxLimit).All(&notifications)
+	conn.Record("pendingEvents", selector, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*realtime.Event
+	for _, n := range notifications {
+		e, err := realtime.NewEvent(n.Channel, n.Event, n.Message)
+		if err != nil {
+			return nil, err
+		}
+		e.ID = n.EventID
+		e.Timestamp = n.CreatedAt
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// InboxConnectHook gateway OnConnect delivering the pending notifications of the connecting recipient
+func InboxConnectHook(recipient RecipientFunc) realtime.ConnectHook {
+	return func(c *gin.Context, channels []string, lastEventID string) ([]*realtime.Event, error) {
+		r, err := recipient(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return PendingEvents(r, lastEventID)
+	}
+}
+
+// MountInbox register the inbox APIs of the recipient of the request:
+// GET path (unread, before, limit), GET path/unread_count and POST path/read {"ids": [], "all": false}
+func MountInbox(route gin.IRoutes, path string, recipient RecipientFunc) {
+	path = strings.TrimSuffix(path, "/")
+
+	route.GET(path, func(c *gin.Context) {
+		r, ok := inboxRecipient(c, recipient)
+		if !ok {
+			return
+		}
+
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		notifications, err := ListInbox(r, InboxQuery{
+			UnreadOnly: c.Query("unread") == "true",
+			Before:     c.Query("before"),
+			Limit:      limit,
+		})
+		if err != nil {
+			helpers.GinHTTPError(c, err)
+			return
+		}
+
+		helpers.GinHTTPOk(c, gin.H{"notifications": notifications})
+	})
+
+	route.GET(path+"/unread_count", func(c *gin.Context) {
+		r, ok := inboxRecipient(c, recipient)
+		if !ok {
+			return
+		}
+
+		count, err := UnreadCount(r)
+		if err != nil {
+			helpers.GinHTTPError(c, err)
+			return
+		}
+
+		helpers.GinHTTPOk(c, gin.H{"unread": count})
+	})
+
+	route.POST(path+"/read", func(c *gin.Context) {
+		r, ok := inboxRecipient(c, recipient)
+		if !ok {
+			return
+		}
+
+		var req markReadReq
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+
+		var (
+			updated int
+			err     error
+		)
+		if req.All {
+			updated, err = MarkAllRead(r)
+		} else {
+			updated, err = MarkRead(r, req.IDs...)
+		}
+		if err != nil {
+			helpers.GinHTTPError(c, err)
+			return
+		}
+
+		helpers.GinHTTPOk(c, gin.H{"updated": updated})
+	})
+}
+
+func inboxRecipient(c *gin.Context, recipient RecipientFunc) (string, bool) {
+	r, err := recipient(c)
+	if err != nil || r == "" {
+		if err == nil {
+			err = fmt.Errorf("no recipient")
+		}
+		helpers.GinHTTPErrWCode(c, http.StatusUnauthorized, err)
+		return "", false
+	}
+
+	return r, true
+}
@@ -6,11 +6,19 @@ import (
 
 	utils "github.com/b-eee/amagi"
 	"github.com/b-eee/amagi/services/externalSvc"
+	"github.com/b-eee/amagi/services/messaging"
+	"github.com/b-eee/amagi/services/messaging/realtime"
 )
 
 var (
 	// NotificatorURL notificator service URL
 	NotificatorURL string
+
+	// Realtime messaging feeding the realtime gateways, Publish delivers through it when set
+	Realtime *messaging.BackendConfig
+
+	// RealtimeTopic topic consumed by the realtime gateways
+	RealtimeTopic = realtime.DefaultTopic
 )
 
 // Init initialize
@@ -23,9 +31,25 @@ func BuildNotificatorURL() string {
 	return NotificatorURL
 }
 
-// Publish publish message to pusher
+// UseRealtimeGateway deliver the notifications to the realtime gateways consuming msg
+// instead of posting them to the notificator service
+func UseRealtimeGateway(msg *messaging.BackendConfig) {
+	Realtime = msg
+}
+
+// Publish publish message to pusher, or to the realtime gateways with UseRealtimeGateway
 func Publish(message interface{}, channel, event string) error {
 	s := time.Now()
+	if Realtime != nil {
+		if err := realtime.Publish(Realtime, RealtimeTopic, channel, event, message); err != nil {
+			utils.Error(fmt.Sprintf("error Publish realtime %v", err))
+			return err
+		}
+
+		utils.Info(fmt.Sprintf("Publish realtime took: %v channel=%v event=%v", time.Since(s), channel, event))
+		return nil
+	}
+
 	url := "/notification/api/push"
 
 	data := map[string]interface{}{
@@ -0,0 +1,366 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+)
+
+type (
+	// OutboxMessage message waiting in the outbox for the broker
+	OutboxMessage struct {
+		ID        string    `bson:"_id" json:"id"`
+		Topic     string    `bson:"topic" json:"topic"`
+		Body      []byte    `bson:"body" json:"body"`
+		CreatedAt time.Time `bson:"created_at" json:"created_at"`
+
+		// FailedAt set when the message can't be published, with the Error
+		FailedAt *time.Time `bson:"failed_at,omitempty" json:"failed_at,omitempty"`
+		Error    string     `bson:"error,omitempty" json:"error,omitempty"`
+
+		// Owner process relaying the message until LeaseUntil, see OutboxClaimer
+		Owner      string     `bson:"owner,omitempty" json:"owner,omitempty"`
+		LeaseUntil *time.Time `bson:"lease_until,omitempty" json:"lease_until,omitempty"`
+	}
+
+	// OutboxStore persistence of the outbox, Pending returns the messages of a topic, or of
+	// every topic when empty, in publish order. Fail keeps a message that can never be
+	// published out of Pending
+	OutboxStore interface {
+		Append(OutboxMessage) error
+		Pending(topic string, limit int) ([]OutboxMessage, error)
+		Remove(id string) error
+		Fail(id string, cause error) error
+	}
+
+	// OutboxClaimer store shared by several processes, the relay claims the messages of a
+	// topic before publishing them instead of reading them with Pending. Remove and Fail
+	// return ErrOutboxLeaseLost once the claim was taken over by another process
+	OutboxClaimer interface {
+		Claim(topic string, limit int) ([]OutboxMessage, error)
+	}
+
+	// Outbox publish through the broker and keep the messages that failed in Store,
+	// a relay started with Start retries them with backoff. Order is kept per topic:
+	// once a topic has messages in the outbox the new ones are queued behind them
+	Outbox struct {
+		Messaging  *BackendConfig
+		Store      OutboxStore
+		Interval   time.Duration
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+		BatchSize  int
+
+		relayMu sync.Mutex
+		mu      sync.Mutex
+		pending map[string]int
+		retries map[string]outboxRetry
+		loaded  bool
+		wake    chan struct{}
+		cancel  context.CancelFunc
+		done    chan struct{}
+	}
+
+	outboxRetry struct {
+		failures int
+		next     time.Time
+	}
+)
+
+var (
+	// DefaultOutboxInterval relay poll interval
+	DefaultOutboxInterval = time.Second
+	// DefaultOutboxMinBackoff first retry delay of a failing topic
+	DefaultOutboxMinBackoff = 500 * time.Millisecond
+	// DefaultOutboxMaxBackoff upper limit of the retry delay of a failing topic
+	DefaultOutboxMaxBackoff = time.Minute
+	// DefaultOutboxBatchSize messages of a topic read from the store per relay pass
+	DefaultOutboxBatchSize = 500
+
+	// ErrOutboxInvalidMessage message without topic or body
+	ErrOutboxInvalidMessage = fmt.Errorf("outbox publish requires topic and body")
+)
+
+// NewOutbox outbox publishing with msg and persisting to store
+func NewOutbox(msg *BackendConfig, store OutboxStore) *Outbox {
+	return &Outbox{
+		Messaging:  msg,
+		Store:      store,
+		Interval:   DefaultOutboxInterval,
+		MinBackoff: DefaultOutboxMinBackoff,
+		MaxBackoff: DefaultOutboxMaxBackoff,
+		BatchSize:  DefaultOutboxBatchSize,
+		pending:    map[string]int{},
+		retries:    map[string]outboxRetry{},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Publish publish req, or store it for the relay when the broker fails or the topic
+// already has messages waiting. Invalid messages, schema validation included, and the
+// errors of the store are returned
+func (o *Outbox) Publish(req PublishReq) error {
+	if len(req.Topic) == 0 || len(req.Body) == 0 {
+		return ErrOutboxInvalidMessage
+	}
+	// validated before queueing, a stored message must be publishable
+	if o.Messaging.Schemas != nil {
+		if err := o.Messaging.Schemas.Validate(req.Topic, req.Body); err != nil {
+			return err
+		}
+	}
+
+	if err := o.load(); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	direct := o.pending[req.Topic] == 0
+	o.mu.Unlock()
+
+	if direct {
+		err := o.Messaging.Publish(req)
+		if err == nil {
+			return nil
+		}
+		if permanentPublishError(err) {
+			return err
+		}
+		utils.Error(fmt.Sprintf("error outbox publish topic=%v, storing for retry: %v", req.Topic, err))
+	}
+
+	// counted before it is stored so the messages published meanwhile queue behind it
+	o.mu.Lock()
+	o.pending[req.Topic]++
+	o.mu.Unlock()
+
+	msg := OutboxMessage{
+		ID:        newOutboxID(),
+		Topic:     req.Topic,
+		Body:      req.Body,
+		CreatedAt: time.Now(),
+	}
+	if err := o.Store.Append(msg); err != nil {
+		o.mu.Lock()
+		o.removed(req.Topic)
+		o.mu.Unlock()
+		utils.Error(fmt.Sprintf("error outbox store topic=%v: %v", req.Topic, err))
+		return err
+	}
+	o.notify()
+
+	return nil
+}
+
+// Pending number of messages of topic waiting in the outbox
+func (o *Outbox) Pending(topic string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.pending[topic]
+}
+
+// Start run the relay until ctx is done or Stop is called
+func (o *Outbox) Start(ctx context.Context) error {
+	if err := o.load(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	o.mu.Lock()
+	o.cancel = cancel
+	o.done = make(chan struct{})
+	done := o.done
+	o.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+		for {
+			o.Relay()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stop the relay and wait for the current pass
+func (o *Outbox) Stop() {
+	o.mu.Lock()
+	cancel, done := o.cancel, o.done
+	o.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Relay publish the stored messages of each topic in order, a topic failing is skipped
+// for the rest of the pass and retried after its backoff. Passes run one at a time
+func (o *Outbox) Relay() {
+	o.relayMu.Lock()
+	defer o.relayMu.Unlock()
+
+	if err := o.load(); err != nil {
+		utils.Error(fmt.Sprintf("error outbox relay load: %v", err))
+		return
+	}
+
+	o.mu.Lock()
+	var topics []string
+	for topic := range o.pending {
+		topics = append(topics, topic)
+	}
+	o.mu.Unlock()
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		o.relayTopic(topic)
+	}
+}
+
+// relayTopic publish the stored messages of topic until one fails
+func (o *Outbox) relayTopic(topic string) {
+	now := time.Now()
+	o.mu.Lock()
+	retry := o.retries[topic]
+	o.mu.Unlock()
+	if now.Before(retry.next) {
+		return
+	}
+
+	var messages []OutboxMessage
+	var err error
+	if claimer, ok := o.Store.(OutboxClaimer); ok {
+		messages, err = claimer.Claim(topic, o.BatchSize)
+	} else {
+		messages, err = o.Store.Pending(topic, o.BatchSize)
+	}
+	if err != nil {
+		utils.Error(fmt.Sprintf("error outbox relay pending topic=%v: %v", topic, err))
+		return
+	}
+
+	for _, msg := range messages {
+		err := ErrOutboxInvalidMessage
+		if len(msg.Topic) != 0 && len(msg.Body) != 0 {
+			err = o.Messaging.Publish(PublishReq{Topic: msg.Topic, Body: msg.Body})
+		}
+		if err != nil && permanentPublishError(err) {
+			// never publishable, kept aside so the messages behind it go on
+			if err := o.Store.Fail(msg.ID, err); err != nil {
+				utils.Error(fmt.Sprintf("error outbox relay fail id=%v: %v", msg.ID, err))
+				o.leaseLost(topic, err)
+				return
+			}
+			utils.Error(fmt.Sprintf("error outbox relay topic=%v id=%v failed permanently: %v", topic, msg.ID, err))
+
+			o.mu.Lock()
+			o.removed(topic)
+			o.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			o.mu.Lock()
+			retry.failures++
+			retry.next = now.Add(o.backoff(retry.failures))
+			o.retries[topic] = retry
+			o.mu.Unlock()
+			utils.Error(fmt.Sprintf("error outbox relay topic=%v failures=%v: %v", topic, retry.failures, err))
+			return
+		}
+
+		// published but not removed: it is sent again on the next pass
+		if err := o.Store.Remove(msg.ID); err != nil {
+			utils.Error(fmt.Sprintf("error outbox relay remove id=%v: %v", msg.ID, err))
+			o.leaseLost(topic, err)
+			return
+		}
+
+		o.mu.Lock()
+		delete(o.retries, topic)
+		o.removed(topic)
+		o.mu.Unlock()
+	}
+}
+
+// permanentPublishError errors a retry can't fix, the message itself is invalid
+func permanentPublishError(err error) bool {
+	if _, ok := err.(*SchemaValidationError); ok {
+		return true
+	}
+
+	return err == ErrOutboxInvalidMessage
+}
+
+// leaseLost the message is relayed by the process that claimed it, not counted here anymore
+func (o *Outbox) leaseLost(topic string, err error) {
+	if err != ErrOutboxLeaseLost {
+		return
+	}
+
+	o.mu.Lock()
+	o.removed(topic)
+	o.mu.Unlock()
+}
+
+// removed one message of topic left the outbox, o.mu must be held
+func (o *Outbox) removed(topic string) {
+	if o.pending[topic]--; o.pending[topic] <= 0 {
+		delete(o.pending, topic)
+	}
+}
+
+// load count the messages left in the store by a previous process
+func (o *Outbox) load() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.loaded {
+		return nil
+	}
+
+	messages, err := o.Store.Pending("", 0)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		o.pending[msg.Topic]++
+	}
+	o.loaded = true
+
+	return nil
+}
+
+func (o *Outbox) backoff(failures int) time.Duration {
+	d := o.MinBackoff
+	for i := 1; i < failures && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+
+	return d
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,315 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/b-eee/amagi/services/database"
+	mongodb "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// MongoOutboxStore outbox stored in a mongodb collection, ordered by _id. The relay
+	// claims the messages for Lease before publishing them, so processes sharing the
+	// collection don't publish the same message, Owner identifies this process
+	MongoOutboxStore struct {
+		Collection string
+		Owner      string
+		Lease      time.Duration
+	}
+
+	// FileOutboxStore outbox stored as a json file, for services without mongodb.
+	// The whole outbox is rewritten on every change, keep it for small outboxes
+	FileOutboxStore struct {
+		Path string
+
+		mu       sync.Mutex
+		messages []OutboxMessage
+		loaded   bool
+	}
+)
+
+var (
+	// OutboxCollection default collection of MongoOutboxStore
+	OutboxCollection = "messaging_outbox"
+	// DefaultOutboxLease time a claimed message is kept by its owner
+	DefaultOutboxLease = 30 * time.Second
+
+	// ErrOutboxLeaseLost the lease of the message expired and another process claimed it
+	ErrOutboxLeaseLost = fmt.Errorf("outbox message claimed by another process")
+
+	outboxSeq uint32
+)
+
+// newOutboxID time ordered outbox message ID
+func newOutboxID() string {
+	return fmt.Sprintf("%019d%010d", time.Now().UnixNano(), atomic.AddUint32(&outboxSeq, 1))
+}
+
+// NewMongoOutboxStore outbox store on OutboxCollection, owned by this process
+func NewMongoOutboxStore() *MongoOutboxStore {
+	host, _ := os.Hostname()
+	return &MongoOutboxStore{
+		Collection: OutboxCollection,
+		Owner:      fmt.Sprintf("%v-%v-%v", host, os.Getpid(), bson.NewObjectId().Hex()),
+		Lease:      DefaultOutboxLease,
+	}
+}
+
+// Append insert msg
+func (store *MongoOutboxStore) Append(msg OutboxMessage) error {
+	return database.MongoInsert(store.Collection, msg)
+}
+
+// Pending oldest messages of topic first, of every topic when empty, limit 0 for all
+func (store *MongoOutboxStore) Pending(topic string, limit int) ([]OutboxMessage, error) {
+	conn := database.BeginMongoWCol()(store.Collection)
+	defer conn.Conn.Close()
+
+	selector := bson.M{"failed_at": nil}
+	if topic != "" {
+		selector["topic"] = topic
+	}
+
+	var messages []OutboxMessage
+	err := conn.Col.Find(selector).Sort("_id").Limit(limit).All(&messages)
+	conn.Record("find", selector, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Claim lease the oldest messages of topic to store.Owner, up to limit. Stops at a message
+// leased by another process to keep the order of the topic
+func (store *MongoOutboxStore) Claim(topic string, limit int) ([]OutboxMessage, error) {
+	conn := database.BeginMongoWCol()(store.Collection)
+	defer conn.Conn.Close()
+
+	var messages []OutboxMessage
+	after := ""
+	for limit <= 0 || len(messages) < limit {
+		selector := bson.M{"topic": topic, "failed_at": nil, "_id": bson.M{"$gt": after}}
+		var next OutboxMessage
+		err := conn.Col.Find(selector).Sort("_id").One(&next)
+		conn.Record("findOne", selector, err)
+		if err == mongodb.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return messages, err
+		}
+
+		// taken only when free, expired or already ours
+		now := time.Now()
+		claim := bson.M{"_id": next.ID, "failed_at": nil, "$or": []bson.M{
+			{"lease_until": nil},
+			{"lease_until": bson.M{"$lt": now}},
+			{"owner": store.Owner},
+		}}
+		var msg OutboxMessage
+		_, err = conn.Col.Find(claim).Apply(mongodb.Change{
+			Update:    bson.M{"$set": bson.M{"owner": store.Owner, "lease_until": now.Add(store.lease())}},
+			ReturnNew: true,
+		}, &msg)
+		conn.Record("claim", claim, err)
+		if err == mongodb.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, msg)
+		after = msg.ID
+	}
+
+	return messages, nil
+}
+
+// Remove delete a published message claimed by store.Owner, ErrOutboxLeaseLost when
+// another process claimed it since
+func (store *MongoOutboxStore) Remove(id string) error {
+	return store.owned(database.MongoRemove(store.Collection, bson.M{"_id": id, "owner": store.Owner}))
+}
+
+// Fail mark a message claimed by store.Owner that can't be published, it is kept for inspection
+func (store *MongoOutboxStore) Fail(id string, cause error) error {
+	return store.owned(database.MongoUpdate(store.Collection, bson.M{"_id": id, "owner": store.Owner}, bson.M{
+		"$set":   bson.M{"failed_at": time.Now(), "error": cause.Error()},
+		"$unset": bson.M{"lease_until": ""},
+	}))
+}
+
+func (store *MongoOutboxStore) owned(err error) error {
+	if err == mongodb.ErrNotFound {
+		return ErrOutboxLeaseLost
+	}
+
+	return err
+}
+
+func (store *MongoOutboxStore) lease() time.Duration {
+	if store.Lease <= 0 {
+		return DefaultOutboxLease
+	}
+
+	return store.Lease
+}
+
+// NewFileOutboxStore outbox store on the json file at path
+func NewFileOutboxStore(path string) *FileOutboxStore {
+	return &FileOutboxStore{Path: path}
+}
+
+// Append add msg and write the file
+func (store *FileOutboxStore) Append(msg OutboxMessage) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	store.messages = append(store.messages, msg)
+	if err := store.write(); err != nil {
+		store.messages = store.messages[:len(store.messages)-1]
+		return err
+	}
+
+	return nil
+}
+
+// Pending oldest messages of topic first, of every topic when empty, limit 0 for all
+func (store *FileOutboxStore) Pending(topic string, limit int) ([]OutboxMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	var messages []OutboxMessage
+	for _, msg := range store.messages {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+		if msg.FailedAt == nil && (topic == "" || msg.Topic == topic) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+// Remove delete a published message and write the file
+func (store *FileOutboxStore) Remove(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	for i, msg := range store.messages {
+		if msg.ID != id {
+			continue
+		}
+
+		messages := append(append([]OutboxMessage{}, store.messages[:i]...), store.messages[i+1:]...)
+		prev := store.messages
+		store.messages = messages
+		if err := store.write(); err != nil {
+			store.messages = prev
+			return err
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// Fail mark a message that can't be published and write the file
+func (store *FileOutboxStore) Fail(id string, cause error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	for i, msg := range store.messages {
+		if msg.ID != id {
+			continue
+		}
+
+		prev := msg
+		now := time.Now()
+		store.messages[i].FailedAt = &now
+		store.messages[i].Error = cause.Error()
+		if err := store.write(); err != nil {
+			store.messages[i] = prev
+			return err
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// load read the file once, store.mu must be held
+func (store *FileOutboxStore) load() error {
+	if store.loaded {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(store.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store.messages); err != nil {
+			return fmt.Errorf("invalid outbox file %v: %v", store.Path, err)
+		}
+	}
+	store.loaded = true
+
+	return nil
+}
+
+// write replace the file atomically, store.mu must be held
+func (store *FileOutboxStore) write() error {
+	data, err := json.Marshal(store.messages)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(store.Path), filepath.Base(store.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), store.Path)
+}
@@ -0,0 +1,284 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/b-eee/amagi/services/messaging/backend"
+)
+
+// flakyBackend memory backend failing every publish while down
+type flakyBackend struct {
+	*backend.MemoryBackend
+
+	mu        sync.Mutex
+	down      bool
+	downTopic string
+}
+
+func (b *flakyBackend) setDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+}
+
+func (b *flakyBackend) Publish(req backend.MSGBackendPubReq) error {
+	b.mu.Lock()
+	down := b.down || b.downTopic == req.Topic
+	b.mu.Unlock()
+
+	if down {
+		return fmt.Errorf("broker down")
+	}
+	return b.MemoryBackend.Publish(req)
+}
+
+// go test -v -run=TestOutbox ./services/messaging
+func TestOutbox(t *testing.T) {
+	b := &flakyBackend{MemoryBackend: backend.NewMemoryBackend()}
+	msg := &BackendConfig{Backend: b}
+	defer msg.Close()
+
+	received := make(chan string, 10)
+	if _, err := msg.Subscribe(SubscribeReq{
+		Topic:   "events",
+		Channel: "test",
+		Handler: func(m *Message) error {
+			received <- string(m.Body)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	outbox := NewOutbox(msg, NewFileOutboxStore(path))
+	outbox.Interval = 10 * time.Millisecond
+	outbox.MinBackoff = 10 * time.Millisecond
+
+	b.setDown(true)
+	for _, body := range []string{"1", "2"} {
+		if err := outbox.Publish(PublishReq{Topic: "events", Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.setDown(false)
+	// queued behind the stored messages to keep the order
+	if err := outbox.Publish(PublishReq{Topic: "events", Body: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := outbox.Pending("events"); n != 3 {
+		t.Fatalf("pending=%v, want 3", n)
+	}
+
+	// a new outbox on the same file resumes the messages of the previous process
+	outbox = NewOutbox(msg, NewFileOutboxStore(path))
+	outbox.Interval = 10 * time.Millisecond
+	if err := outbox.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Stop()
+
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case body := <-received:
+			if body != want {
+				t.Errorf("received %v, want %v", body, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %v not relayed", want)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for outbox.Pending("events") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending=%v, want 0 once relayed", outbox.Pending("events"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	outbox := NewOutbox(&BackendConfig{}, NewFileOutboxStore(""))
+	outbox.MinBackoff = time.Second
+	outbox.MaxBackoff = 5 * time.Second
+
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 5 * time.Second} {
+		if got := outbox.backoff(failures); got != want {
+			t.Errorf("backoff(%v)=%v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestOutboxFailingTopicDoesNotBlockOthers(t *testing.T) {
+	b := &flakyBackend{MemoryBackend: backend.NewMemoryBackend(), downTopic: "stuck"}
+	msg := &BackendConfig{Backend: b}
+	defer msg.Close()
+
+	received := make(chan string, 10)
+	if _, err := msg.Subscribe(SubscribeReq{
+		Topic:   "events",
+		Channel: "test",
+		Handler: func(m *Message) error {
+			received <- string(m.Body)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// left by a previous process, the failing topic first and more than a batch
+	store := NewFileOutboxStore(filepath.Join(t.TempDir(), "outbox.json"))
+	for i, topic := range []string{"stuck", "stuck", "stuck", "events"} {
+		if err := store.Append(OutboxMessage{ID: newOutboxID(), Topic: topic, Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outbox := NewOutbox(msg, store)
+	outbox.BatchSize = 2
+	if err := outbox.Publish(PublishReq{Topic: "events", Body: []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outbox.Relay()
+		}()
+	}
+	wg.Wait()
+
+	for _, want := range []string{"3", "4"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("events not relayed behind the failing topic")
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("relayed twice: %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if n := outbox.Pending("stuck"); n != 3 {
+		t.Errorf("stuck pending=%v, want 3", n)
+	}
+	if n := outbox.Pending("events"); n != 0 {
+		t.Errorf("events pending=%v, want 0", n)
+	}
+}
+
+func TestOutboxInvalidMessage(t *testing.T) {
+	msg := &BackendConfig{Backend: &flakyBackend{MemoryBackend: backend.NewMemoryBackend()}}
+	defer msg.Close()
+	msg.Schemas = NewSchemaRegistry()
+	msg.Schemas.Register("orders", "1", orderSchemaV1)
+
+	received := make(chan string, 10)
+	if _, err := msg.Subscribe(SubscribeReq{Topic: "orders", Channel: "test", Handler: func(m *Message) error {
+		received <- string(m.Body)
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileOutboxStore(filepath.Join(t.TempDir(), "outbox.json"))
+	outbox := NewOutbox(msg, store)
+
+	// returned to the caller, never stored
+	err := outbox.Publish(PublishReq{Topic: "orders", Body: []byte(`{"id": 1}`)})
+	if _, ok := err.(*SchemaValidationError); !ok {
+		t.Errorf("err=%v, want a SchemaValidationError", err)
+	}
+	if err := outbox.Publish(PublishReq{Topic: "orders"}); err != ErrOutboxInvalidMessage {
+		t.Errorf("err=%v, want ErrOutboxInvalidMessage", err)
+	}
+	if n := outbox.Pending("orders"); n != 0 {
+		t.Errorf("pending=%v, want 0", n)
+	}
+
+	// stored before the schema, failed by the relay without blocking the topic
+	invalid := OutboxMessage{ID: newOutboxID(), Topic: "orders", Body: []byte(`{"id": 1}`)}
+	valid := OutboxMessage{ID: newOutboxID(), Topic: "orders", Body: []byte(`{"id": "1", "total": 2}`)}
+	for _, m := range []OutboxMessage{invalid, valid} {
+		if err := store.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outbox = NewOutbox(msg, store)
+	outbox.Relay()
+
+	select {
+	case body := <-received:
+		if body != string(valid.Body) {
+			t.Errorf("received %v, want %v", body, string(valid.Body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("valid message not relayed behind the invalid one")
+	}
+	if n := outbox.Pending("orders"); n != 0 {
+		t.Errorf("pending=%v, want 0", n)
+	}
+
+	// kept in the store, out of Pending
+	reloaded := NewFileOutboxStore(store.Path)
+	if pending, err := reloaded.Pending("orders", 0); err != nil || len(pending) != 0 {
+		t.Errorf("pending=%v err=%v, want none", pending, err)
+	}
+	reloaded.mu.Lock()
+	defer reloaded.mu.Unlock()
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.messages) != 1 || reloaded.messages[0].ID != invalid.ID || reloaded.messages[0].FailedAt == nil || reloaded.messages[0].Error == "" {
+		t.Errorf("unexpected stored messages %+v", reloaded.messages)
+	}
+}
+
+// claimingStore file store claimed by another process once relayed
+type claimingStore struct {
+	*FileOutboxStore
+	claimed int
+}
+
+func (store *claimingStore) Claim(topic string, limit int) ([]OutboxMessage, error) {
+	store.claimed++
+	return store.Pending(topic, limit)
+}
+
+func (store *claimingStore) Remove(id string) error {
+	return ErrOutboxLeaseLost
+}
+
+func TestOutboxLeaseLost(t *testing.T) {
+	msg := &BackendConfig{Backend: backend.NewMemoryBackend()}
+	defer msg.Close()
+
+	store := &claimingStore{FileOutboxStore: NewFileOutboxStore(filepath.Join(t.TempDir(), "outbox.json"))}
+	if err := store.Append(OutboxMessage{ID: newOutboxID(), Topic: "events", Body: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := NewOutbox(msg, store)
+	outbox.Relay()
+
+	if store.claimed != 1 {
+		t.Errorf("claimed=%v, want the relay to claim", store.claimed)
+	}
+	// left to the process holding the claim, new messages are not queued behind it
+	if n := outbox.Pending("events"); n != 0 {
+		t.Errorf("pending=%v, want 0", n)
+	}
+}
@@ -0,0 +1,372 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/helpers"
+	"github.com/b-eee/amagi/services/messaging"
+)
+
+type (
+	// Event notification pushed to the clients subscribed to its channel
+	Event struct {
+		ID        string          `json:"id"`
+		Channel   string          `json:"channel"`
+		Event     string          `json:"event"`
+		Data      json.RawMessage `json:"data"`
+		Timestamp time.Time       `json:"timestamp"`
+	}
+
+	// Authorizer check the request may subscribe to channels, an error rejects the client with 403
+	Authorizer func(c *gin.Context, channels []string) error
+
+	// ConnectHook events to deliver to a connecting client on top of the replayed ones,
+	// e.g. the unread notifications of the user newer than lastEventID
+	ConnectHook func(c *gin.Context, channels []string, lastEventID string) ([]*Event, error)
+
+	// Gateway push the events published on Topic to WebSocket and Server-Sent-Events clients.
+	// Every gateway instance consumes all the events, the last ReplaySize events of each
+	// channel are kept to replay what a reconnecting client missed since its last event ID
+	Gateway struct {
+		Messaging  *messaging.BackendConfig
+		Topic      string
+		Channel    string
+		Authorize  Authorizer
+		OnConnect  ConnectHook
+		ReplaySize int
+		BufferSize int
+
+		// AllowedOrigins origins of the cross-origin websocket clients, e.g. "https://app.example.com",
+		// "*" for any. The same origin is always allowed
+		AllowedOrigins []string
+
+		mu      sync.RWMutex
+		clients map[string]map[*client]bool
+		history map[string][]*Event
+		sub     messaging.Subscription
+	}
+
+	// client connected WebSocket or SSE client
+	client struct {
+		channels map[string]bool
+		events   map[string]bool
+		send     chan *Event
+		done     chan struct{}
+		once     sync.Once
+	}
+)
+
+var (
+	// DefaultTopic messaging topic of the realtime events
+	DefaultTopic = "realtime_events"
+
+	// DefaultReplaySize events kept per channel for replay
+	DefaultReplaySize = 100
+
+	// DefaultBufferSize events queued per client, a client falling behind is disconnected
+	// and replays the missed events on reconnect
+	DefaultBufferSize = 64
+
+	eventSeq uint32
+)
+
+// NewGateway gateway consuming DefaultTopic of msg, authorize is required
+func NewGateway(msg *messaging.BackendConfig, authorize Authorizer) *Gateway {
+	return &Gateway{
+		Messaging:  msg,
+		Topic:      DefaultTopic,
+		Authorize:  authorize,
+		ReplaySize: DefaultReplaySize,
+		BufferSize: DefaultBufferSize,
+		clients:    map[string]map[*client]bool{},
+		history:    map[string][]*Event{},
+	}
+}
+
+// NewEvent event of data marshalled to json, with a time ordered ID. The event name can't
+// contain line breaks, they would break the SSE framing
+func NewEvent(channel, event string, data interface{}) (*Event, error) {
+	if strings.ContainsAny(event, "\r\n") {
+		return nil, fmt.Errorf("realtime event name can't contain line breaks: %q", event)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Event{
+		ID:        fmt.Sprintf("%019d%010d", now.UnixNano(), atomic.AddUint32(&eventSeq, 1)),
+		Channel:   channel,
+		Event:     event,
+		Data:      raw,
+		Timestamp: now,
+	}, nil
+}
+
+// Publish publish an event to the gateways consuming topic
+func Publish(msg *messaging.BackendConfig, topic, channel, event string, data interface{}) error {
+	e, err := NewEvent(channel, event, data)
+	if err != nil {
+		return err
+	}
+
+	return PublishEvent(msg, topic, e)
+}
+
+// PublishEvent publish e to the gateways consuming topic
+func PublishEvent(msg *messaging.BackendConfig, topic string, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return msg.Publish(messaging.PublishReq{Topic: topic, Body: body})
+}
+
+// Start consume the events of Topic, each gateway instance with its own channel
+func (gw *Gateway) Start() error {
+	if gw.Authorize == nil {
+		return fmt.Errorf("realtime gateway requires an Authorizer")
+	}
+
+	channel := gw.Channel
+	if channel == "" {
+		channel = gatewayChannel(gw.Messaging.ConfigEnv.Backend)
+	}
+
+	sub, err := gw.Messaging.Subscribe(messaging.SubscribeReq{
+		Topic:   gw.Topic,
+		Channel: channel,
+		Handler: gw.handle,
+	})
+	if err != nil {
+		return err
+	}
+
+	gw.mu.Lock()
+	gw.sub = sub
+	gw.mu.Unlock()
+
+	utils.Info(fmt.Sprintf("realtime gateway started topic=%v chan=%v", gw.Topic, channel))
+	return nil
+}
+
+// Stop stop consuming and disconnect the clients
+func (gw *Gateway) Stop() error {
+	gw.mu.Lock()
+	sub := gw.sub
+	gw.sub = nil
+	var clients []*client
+	for _, chClients := range gw.clients {
+		for cl := range chClients {
+			clients = append(clients, cl)
+		}
+	}
+	gw.mu.Unlock()
+
+	for _, cl := range clients {
+		cl.close()
+	}
+	if sub != nil {
+		return sub.Close()
+	}
+
+	return nil
+}
+
+// Mount register the WebSocket handler on path/ws and the SSE handler on path/sse
+func (gw *Gateway) Mount(route gin.IRoutes, path string) {
+	path = strings.TrimSuffix(path, "/")
+	route.GET(path+"/ws", gw.WebSocketHandler)
+	route.GET(path+"/sse", gw.SSEHandler)
+}
+
+// handle deliver a consumed event to the subscribed clients
+func (gw *Gateway) handle(m *messaging.Message) error {
+	var e Event
+	if err := json.Unmarshal(m.Body, &e); err != nil || e.Channel == "" {
+		utils.Error(fmt.Sprintf("error realtime gateway invalid event topic=%v err=%v", m.Topic, err))
+		return nil
+	}
+	// published without NewEvent, the SSE fields must stay on one line
+	if strings.ContainsAny(e.ID+e.Event, "\r\n") {
+		utils.Error(fmt.Sprintf("error realtime gateway event with line breaks dropped topic=%v event=%q", m.Topic, e.Event))
+		return nil
+	}
+
+	gw.dispatch(&e)
+	return nil
+}
+
+func (gw *Gateway) dispatch(e *Event) {
+	gw.mu.Lock()
+	history := append(gw.history[e.Channel], e)
+	if len(history) > gw.ReplaySize {
+		history = history[len(history)-gw.ReplaySize:]
+	}
+	gw.history[e.Channel] = history
+
+	var slow []*client
+	for cl := range gw.clients[e.Channel] {
+		if !cl.accepts(e) {
+			continue
+		}
+		select {
+		case cl.send <- e:
+		default:
+			slow = append(slow, cl)
+		}
+	}
+	gw.mu.Unlock()
+
+	for _, cl := range slow {
+		utils.Info(fmt.Sprintf("realtime client too slow, disconnected chan=%v", e.Channel))
+		cl.close()
+	}
+}
+
+// connect authorize and register a client for the channels and events of the request,
+// queueing the events missed since lastEventID
+func (gw *Gateway) connect(c *gin.Context, lastEventID string) (*client, bool) {
+	channels := splitParam(c.Query("channels"))
+	if len(channels) == 0 {
+		helpers.GinHTTPErrWCode(c, http.StatusBadRequest, fmt.Errorf("channels is required"))
+		return nil, false
+	}
+	// a gateway mounted without Authorizer rejects every client
+	if gw.Authorize == nil {
+		helpers.GinHTTPErrWCode(c, http.StatusForbidden, fmt.Errorf("realtime gateway requires an Authorizer"))
+		return nil, false
+	}
+	if err := gw.Authorize(c, channels); err != nil {
+		helpers.GinHTTPErrWCode(c, http.StatusForbidden, err)
+		return nil, false
+	}
+
+	cl := &client{
+		channels: map[string]bool{},
+		events:   map[string]bool{},
+		done:     make(chan struct{}),
+	}
+	for _, ch := range channels {
+		cl.channels[ch] = true
+	}
+	for _, ev := range splitParam(c.Query("events")) {
+		cl.events[ev] = true
+	}
+
+	var missed []*Event
+	if gw.OnConnect != nil {
+		events, err := gw.OnConnect(c, channels, lastEventID)
+		if err != nil {
+			utils.Error(fmt.Sprintf("error realtime gateway OnConnect %v", err))
+		}
+		for _, e := range events {
+			if cl.accepts(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if lastEventID != "" {
+		for ch := range cl.channels {
+			for _, e := range gw.history[ch] {
+				if e.ID > lastEventID && cl.accepts(e) {
+					missed = append(missed, e)
+				}
+			}
+		}
+	}
+	missed = uniqueEvents(missed)
+
+	size := gw.BufferSize
+	if size < len(missed) {
+		size = len(missed)
+	}
+	cl.send = make(chan *Event, size)
+	for _, e := range missed {
+		cl.send <- e
+	}
+
+	for ch := range cl.channels {
+		if gw.clients[ch] == nil {
+			gw.clients[ch] = map[*client]bool{}
+		}
+		gw.clients[ch][cl] = true
+	}
+
+	return cl, true
+}
+
+func (gw *Gateway) disconnect(cl *client) {
+	cl.close()
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	for ch := range cl.channels {
+		delete(gw.clients[ch], cl)
+		if len(gw.clients[ch]) == 0 {
+			delete(gw.clients, ch)
+		}
+	}
+}
+
+func (cl *client) accepts(e *Event) bool {
+	return cl.channels[e.Channel] && (len(cl.events) == 0 || cl.events[e.Event])
+}
+
+func (cl *client) close() {
+	cl.once.Do(func() { close(cl.done) })
+}
+
+// gatewayChannel per instance channel, ephemeral on nsq so it is removed with the instance
+func gatewayChannel(backendName string) string {
+	name := fmt.Sprintf("realtime_%v", helpers.RandString6(12))
+	if backendName == "nsq" {
+		name += "#ephemeral"
+	}
+
+	return name
+}
+
+func splitParam(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// uniqueEvents sort the events by ID without the duplicates
+func uniqueEvents(events []*Event) []*Event {
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	var unique []*Event
+	for i, e := range events {
+		if i > 0 && e.ID == events[i-1].ID {
+			continue
+		}
+		unique = append(unique, e)
+	}
+
+	return unique
+}
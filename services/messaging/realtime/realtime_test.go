@@ -0,0 +1,269 @@
+package realtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/b-eee/amagi/services/messaging"
+	"github.com/b-eee/amagi/services/messaging/backend"
+)
+
+func startGateway(t *testing.T) (*messaging.BackendConfig, *Gateway, *httptest.Server) {
+	msg, err := messaging.NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw := NewGateway(msg, func(c *gin.Context, channels []string) error {
+		if c.Query("token") != "secret" {
+			return fmt.Errorf("invalid token")
+		}
+		return nil
+	})
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	gw.Mount(router, "/realtime")
+	server := httptest.NewServer(router)
+
+	t.Cleanup(func() {
+		server.Close()
+		gw.Stop()
+		msg.Close()
+	})
+	return msg, gw, server
+}
+
+// waitClients wait until n clients are registered on channel
+func waitClients(t *testing.T, gw *Gateway, channel string, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		gw.mu.RLock()
+		count := len(gw.clients[channel])
+		gw.mu.RUnlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clients=%v on %v, want %v", count, channel, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitHistory wait until n events of channel are kept for replay
+func waitHistory(t *testing.T, gw *Gateway, channel string, n int) []*Event {
+	deadline := time.Now().Add(time.Second)
+	for {
+		gw.mu.RLock()
+		history := gw.history[channel]
+		gw.mu.RUnlock()
+		if len(history) == n {
+			return history
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history=%v on %v, want %v", len(history), channel, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSSEReplay(t *testing.T) {
+	msg, gw, server := startGateway(t)
+
+	for i := 1; i <= 3; i++ {
+		if err := Publish(msg, DefaultTopic, "user_1", "updated", map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := waitHistory(t, gw, "user_1", 3)
+
+	req, _ := http.NewRequest("GET", server.URL+"/realtime/sse?channels=user_1&token=secret", nil)
+	req.Header.Set("Last-Event-ID", history[0].ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %v", ct)
+	}
+
+	lines := make(chan string, 20)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				lines <- strings.TrimPrefix(scanner.Text(), "data: ")
+			}
+		}
+	}()
+
+	waitClients(t, gw, "user_1", 1)
+	Publish(msg, DefaultTopic, "user_1", "updated", map[string]int{"n": 4})
+
+	// events 2 and 3 replayed after the last event ID, then the live one
+	for _, want := range []string{`{"n":2}`, `{"n":3}`, `{"n":4}`} {
+		select {
+		case data := <-lines:
+			if data != want {
+				t.Errorf("data=%v, want %v", data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %v not received", want)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	msg, gw, server := startGateway(t)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/realtime/ws?channels=user_1,user_2&events=created&token=secret"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitClients(t, gw, "user_2", 1)
+	Publish(msg, DefaultTopic, "user_2", "deleted", "filtered out")
+	Publish(msg, DefaultTopic, "user_3", "created", "other channel")
+	Publish(msg, DefaultTopic, "user_2", "created", "hello")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var e Event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	json.Unmarshal(e.Data, &data)
+	if e.Channel != "user_2" || e.Event != "created" || data != "hello" {
+		t.Errorf("unexpected event %+v data=%v", e, data)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	_, gw, server := startGateway(t)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/realtime/ws?channels=user_1&token=secret"
+
+	header := http.Header{"Origin": []string{"https://evil.example.com"}}
+	if conn, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		conn.Close()
+		t.Error("cross-origin websocket must be rejected")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-origin websocket, err=%v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{server.URL}})
+	if err != nil {
+		t.Fatalf("same origin websocket rejected: %v", err)
+	}
+	conn.Close()
+
+	gw.AllowedOrigins = []string{"https://app.example.com"}
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("allowed origin websocket rejected: %v", err)
+	}
+	conn.Close()
+}
+
+func TestWriteSSE(t *testing.T) {
+	var b strings.Builder
+	e := &Event{ID: "1", Event: "created", Data: json.RawMessage("{\"a\":\n1}\r\nevent: injected")}
+	if err := writeSSE(&b, e); err != nil {
+		t.Fatal(err)
+	}
+	want := "id: 1\nevent: created\ndata: {\"a\":\ndata: 1}\ndata: event: injected\n\n"
+	if b.String() != want {
+		t.Errorf("writeSSE=%q, want %q", b.String(), want)
+	}
+
+	if _, err := NewEvent("user_1", "created\nevent: injected", "x"); err == nil {
+		t.Error("an event name with a line break must be rejected")
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, _, server := startGateway(t)
+
+	resp, err := http.Get(server.URL + "/realtime/sse?channels=user_1&token=wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status=%v, want 403", resp.StatusCode)
+	}
+
+	if _, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/realtime/ws?token=secret", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without channels, err=%v", err)
+	}
+}
+
+func TestWithoutAuthorizer(t *testing.T) {
+	gw := NewGateway(nil, nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	gw.Mount(router, "/realtime")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/realtime/sse?channels=user_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status=%v, want 403", resp.StatusCode)
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	msg, gw, server := startGateway(t)
+
+	Publish(msg, DefaultTopic, "user_1", "updated", "live")
+	history := waitHistory(t, gw, "user_1", 1)
+
+	stored, _ := NewEvent("user_1", "notified", "stored")
+	gw.OnConnect = func(c *gin.Context, channels []string, lastEventID string) ([]*Event, error) {
+		// the live event is also kept by the gateway, it is delivered once
+		return []*Event{history[0], stored}, nil
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/realtime/ws?channels=user_1&token=secret&last_event_id=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, want := range []string{history[0].ID, stored.ID} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var e Event
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != want {
+			t.Errorf("event %v, want %v", e.ID, want)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var e Event
+	if err := conn.ReadJSON(&e); err == nil {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
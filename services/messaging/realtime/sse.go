@@ -0,0 +1,81 @@
+package realtime
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// SSEHeartbeatInterval period of the keep-alive comments sent to idle SSE clients
+	SSEHeartbeatInterval = 15 * time.Second
+)
+
+// SSEHandler push the events as Server-Sent-Events, query: channels, events. Browsers
+// reconnect with the Last-Event-ID header, last_event_id is accepted as well
+func (gw *Gateway) SSEHandler(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+
+	cl, ok := gw.connect(c, lastEventID)
+	if !ok {
+		return
+	}
+	defer gw.disconnect(cl)
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(SSEHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-cl.done:
+			return
+		case e := <-cl.send:
+			if err := writeSSE(c.Writer, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE write e as a Server-Sent-Event, a data line per line of the data
+func writeSSE(w io.Writer, e *Event) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %s\nevent: %s\n", e.ID, e.Event)
+
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(e.Data))
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
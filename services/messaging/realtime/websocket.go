@@ -0,0 +1,109 @@
+package realtime
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	utils "github.com/b-eee/amagi"
+)
+
+var (
+	// WebSocketPingInterval ping period of the websocket connections
+	WebSocketPingInterval = 30 * time.Second
+
+	// WebSocketWriteTimeout write deadline of a websocket message
+	WebSocketWriteTimeout = 10 * time.Second
+
+	// Upgrader websocket upgrader, without CheckOrigin only the same origin and the
+	// Gateway AllowedOrigins are accepted
+	Upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+)
+
+// WebSocketHandler push the events as json text messages, query: channels, events, last_event_id
+func (gw *Gateway) WebSocketHandler(c *gin.Context) {
+	cl, ok := gw.connect(c, c.Query("last_event_id"))
+	if !ok {
+		return
+	}
+	defer gw.disconnect(cl)
+
+	upgrader := gw.upgrader()
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		utils.Error(fmt.Sprintf("error realtime websocket upgrade %v", err))
+		return
+	}
+	defer conn.Close()
+
+	// the read loop handles pongs and notices the client leaving
+	conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+	})
+	go func() {
+		defer cl.close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(WebSocketPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-cl.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(WebSocketWriteTimeout))
+			return
+		case e := <-cl.send:
+			conn.SetWriteDeadline(time.Now().Add(WebSocketWriteTimeout))
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WebSocketWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// upgrader Upgrader checking the origin against AllowedOrigins unless it has its own CheckOrigin
+func (gw *Gateway) upgrader() websocket.Upgrader {
+	upgrader := Upgrader
+	if upgrader.CheckOrigin == nil {
+		upgrader.CheckOrigin = gw.checkOrigin
+	}
+
+	return upgrader
+}
+
+// checkOrigin accept the requests without Origin, from the same host or from AllowedOrigins
+func (gw *Gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range gw.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
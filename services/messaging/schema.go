@@ -0,0 +1,131 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/services/messaging/backend"
+)
+
+type (
+	// SchemaRegistry json schemas of the topics by version. Envelopes are validated against
+	// their SchemaVersion, raw bodies against the last version registered for the topic
+	SchemaRegistry struct {
+		mu      sync.RWMutex
+		schemas map[string]map[string]*gojsonschema.Schema
+		latest  map[string]string
+	}
+
+	// SchemaValidationError message not matching the schema of its topic
+	SchemaValidationError struct {
+		Topic   string
+		Version string
+		Errors  []string
+	}
+)
+
+// NewSchemaRegistry empty schema registry
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas: map[string]map[string]*gojsonschema.Schema{},
+		latest:  map[string]string{},
+	}
+}
+
+func (e *SchemaValidationError) Error() string {
+	return fmt.Sprintf("message does not match schema topic=%v version=%v: %v", e.Topic, e.Version, strings.Join(e.Errors, "; "))
+}
+
+// Register compile and register the json schema of topic at version, the latest version of the topic
+func (registry *SchemaRegistry) Register(topic, version string, schema []byte) error {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return fmt.Errorf("invalid schema topic=%v version=%v: %v", topic, version, err)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if registry.schemas[topic] == nil {
+		registry.schemas[topic] = map[string]*gojsonschema.Schema{}
+	}
+	registry.schemas[topic][version] = compiled
+	registry.latest[topic] = version
+
+	return nil
+}
+
+// Has whether topic has a registered schema
+func (registry *SchemaRegistry) Has(topic string) bool {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return len(registry.schemas[topic]) > 0
+}
+
+// Validate validate a published body of topic, envelope or raw json. Topics without
+// schema and non json envelopes are not validated
+func (registry *SchemaRegistry) Validate(topic string, body []byte) error {
+	if !registry.Has(topic) {
+		return nil
+	}
+
+	env := DecodeEnvelope(body)
+	if env.ContentType != ContentTypeJSON {
+		return nil
+	}
+
+	return registry.ValidateVersion(topic, env.SchemaVersion, env.Body)
+}
+
+// ValidateVersion validate a json document against the schema of topic at version, the latest when empty
+func (registry *SchemaRegistry) ValidateVersion(topic, version string, document []byte) error {
+	registry.mu.RLock()
+	if version == "" {
+		version = registry.latest[topic]
+	}
+	schema, ok := registry.schemas[topic][version]
+	registry.mu.RUnlock()
+
+	if !ok {
+		return &SchemaValidationError{Topic: topic, Version: version, Errors: []string{"unknown schema version"}}
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(document))
+	if err != nil {
+		return &SchemaValidationError{Topic: topic, Version: version, Errors: []string{err.Error()}}
+	}
+	if !result.Valid() {
+		verr := &SchemaValidationError{Topic: topic, Version: version}
+		for _, desc := range result.Errors() {
+			verr.Errors = append(verr.Errors, desc.String())
+		}
+		return verr
+	}
+
+	return nil
+}
+
+// ValidateSchema middleware validating the consumed messages. Invalid messages are
+// dead-lettered when deadLetter is set, the subscription needs a Redelivery policy,
+// and dropped otherwise
+func ValidateSchema(registry *SchemaRegistry, deadLetter bool) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *Message) error {
+			if err := registry.Validate(m.Topic, m.Body); err != nil {
+				if deadLetter {
+					return backend.Permanent(err)
+				}
+
+				utils.Error(fmt.Sprintf("invalid message dropped chan=%v id=%v: %v", m.Channel, m.ID, err))
+				return nil
+			}
+
+			return next(m)
+		}
+	}
+}
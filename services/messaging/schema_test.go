@@ -0,0 +1,128 @@
+package messaging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b-eee/amagi/services/messaging/backend"
+)
+
+var orderSchemaV1 = []byte(`{
+	"type": "object",
+	"required": ["id", "total"],
+	"properties": {
+		"id": {"type": "string"},
+		"total": {"type": "integer", "minimum": 0}
+	}
+}`)
+
+// go test -v -run=TestSchemaRegistry ./services/messaging
+func TestSchemaRegistry(t *testing.T) {
+	registry := NewSchemaRegistry()
+	if err := registry.Register("orders", "1", orderSchemaV1); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("orders", "2", []byte(`{"type": "object", "required": ["id"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("orders", "3", []byte(`{"type": 12}`)); err == nil {
+		t.Error("expected invalid schema error")
+	}
+
+	// raw bodies use the latest version
+	if err := registry.Validate("orders", []byte(`{"id": "o1"}`)); err != nil {
+		t.Errorf("latest version: %v", err)
+	}
+	if err := registry.Validate("others", []byte(`not json`)); err != nil {
+		t.Errorf("topic without schema: %v", err)
+	}
+
+	env, _ := NewEnvelope(map[string]interface{}{"id": "o1", "total": -1}, nil)
+	env.SchemaVersion = "1"
+	data, _ := env.Encode()
+	err := registry.Validate("orders", data)
+	verr, ok := err.(*SchemaValidationError)
+	if !ok || verr.Version != "1" || !strings.Contains(verr.Error(), "total") {
+		t.Errorf("expected a validation error on total, got %v", err)
+	}
+}
+
+// go test -v -run=TestSchemaPublishConsume ./services/messaging
+func TestSchemaPublishConsume(t *testing.T) {
+	b, err := NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Schemas = NewSchemaRegistry()
+	b.Schemas.Register("orders", "1", orderSchemaV1)
+
+	if err := b.PublishValue(PublishValueReq{Topic: "orders", Value: map[string]interface{}{"id": 1}}); err == nil {
+		t.Error("invalid publish must be rejected")
+	}
+
+	received := make(chan string, 1)
+	dead := make(chan *Message, 1)
+	b.Subscribe(SubscribeReq{Topic: "orders.dead", Channel: "test", Handler: func(m *Message) error {
+		dead <- m
+		return nil
+	}})
+	b.Subscribe(SubscribeReq{
+		Topic:      "orders",
+		Channel:    "test",
+		Redelivery: &RedeliveryPolicy{MaxAttempts: 5},
+		Handler: func(m *Message) error {
+			received <- string(m.Body)
+			return nil
+		},
+	})
+
+	// published by a producer without the registry
+	if err := b.Backend.Publish(backend.MSGBackendPubReq{Topic: "orders", Body: []byte(`{"id": "o1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-dead:
+		var dl DeadLetter
+		json.Unmarshal(m.Body, &dl)
+		if dl.Attempts != 1 || !strings.Contains(dl.Error, "total") {
+			t.Errorf("unexpected dead letter %+v", dl)
+		}
+	case body := <-received:
+		t.Fatalf("invalid message handled %v", body)
+	case <-time.After(time.Second):
+		t.Fatal("invalid message not dead-lettered")
+	}
+}
+
+func TestSchemaRegisteredAfterSubscribe(t *testing.T) {
+	b, err := NewMessaging(backend.MSGBackendConfig{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Schemas = NewSchemaRegistry()
+	received := make(chan string, 2)
+	b.Subscribe(SubscribeReq{Topic: "orders", Channel: "test", Handler: func(m *Message) error {
+		received <- string(m.Body)
+		return nil
+	}})
+	b.Schemas.Register("orders", "1", orderSchemaV1)
+
+	b.Backend.Publish(backend.MSGBackendPubReq{Topic: "orders", Body: []byte(`{"id": "o1"}`)})
+	b.Backend.Publish(backend.MSGBackendPubReq{Topic: "orders", Body: []byte(`{"id": "o2", "total": 1}`)})
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body, "o2") {
+			t.Errorf("invalid message handled %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("valid message not handled")
+	}
+}
@@ -2,16 +2,14 @@ package messaging
 
 import (
 	"encoding/json"
-	// utils "github.com/b-eee/amagi"
+	"fmt"
 )
 
 // GetBytes get arbitrary interface bytes
 func GetBytes(data interface{}) ([]byte, error) {
-	// defer utils.ExceptionDump()
-
 	m, err := json.Marshal(data)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("GetBytes marshal %T: %v", data, err)
 	}
 	return m, nil
 }
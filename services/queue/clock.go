@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Clock time source of the Scheduler, replaceable by FakeClock in tests
+	Clock interface {
+		// Now current time
+		Now() time.Time
+		// After wait for the duration to elapse and send the current time on the returned channel
+		After(time.Duration) <-chan time.Time
+		// NewTicker create a ticker sending the time on its channel every duration
+		NewTicker(time.Duration) Ticker
+	}
+
+	// Ticker ticker interface returned by Clock.NewTicker
+	Ticker interface {
+		// C channel the ticks are delivered on
+		C() <-chan time.Time
+		// Stop turn off the ticker
+		Stop()
+	}
+
+	realClock struct{}
+
+	realTicker struct {
+		ticker *time.Ticker
+	}
+
+	// FakeClock manually advanced clock for deterministic scheduler tests
+	FakeClock struct {
+		mu      sync.Mutex
+		now     time.Time
+		waiters []*fakeWaiter
+		changed chan struct{}
+	}
+
+	fakeWaiter struct {
+		until  time.Time
+		period time.Duration
+		ch     chan time.Time
+		done   bool
+	}
+
+	fakeTicker struct {
+		clock  *FakeClock
+		waiter *fakeWaiter
+	}
+)
+
+var (
+	// RealClock the system clock, default for schedulers
+	RealClock Clock = realClock{}
+)
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// NewFakeClock create a fake clock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+// Now current fake time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// After fires once the clock is advanced past the duration
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{until: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.addWaiter(w)
+	c.fire()
+
+	return w.ch
+}
+
+// NewTicker ticks every time the clock is advanced past the next period
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{until: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.addWaiter(w)
+
+	return &fakeTicker{clock: c, waiter: w}
+}
+
+// Advance move the clock forward and fire all timers that are due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// BlockUntil wait until at least n timers or tickers are waiting on the clock
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting, changed := len(c.waiters), c.changed
+		c.mu.Unlock()
+
+		if waiting >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// addWaiter register a waiter and wake up BlockUntil, c.mu must be held
+func (c *FakeClock) addWaiter(w *fakeWaiter) {
+	c.waiters = append(c.waiters, w)
+	c.notify()
+}
+
+// fire deliver the current time to all due waiters, c.mu must be held
+func (c *FakeClock) fire() {
+	var pending []*fakeWaiter
+	for _, w := range c.waiters {
+		if w.done {
+			continue
+		}
+		if !w.until.After(c.now) {
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+			if w.period <= 0 {
+				continue
+			}
+			for !w.until.After(c.now) {
+				w.until = w.until.Add(w.period)
+			}
+		}
+		pending = append(pending, w)
+	}
+
+	if len(pending) != len(c.waiters) {
+		c.waiters = pending
+		c.notify()
+	}
+}
+
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.waiter.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.waiter.done = true
+	t.clock.fire()
+}
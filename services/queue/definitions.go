@@ -0,0 +1,356 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/helpers"
+	"github.com/b-eee/amagi/services/configctl"
+	"github.com/robfig/cron"
+)
+
+type (
+	// ScheduleDefinition declarative schedule of a registered task
+	//
+	// For example in yaml:
+	//
+	//	schedules:
+	//	  - name: nightly_report
+	//	    task: report
+	//	    cron: "0 2 * * *"
+	//	    timezone: Asia/Tokyo
+	//	  - name: cleanup
+	//	    interval: 15m
+	//	    enabled: false
+	ScheduleDefinition struct {
+		// Name scheduler name, also used as task name when Task is empty
+		Name string `yaml:"name" json:"name"`
+		// Task name of the task registered with RegisterTask
+		Task string `yaml:"task" json:"task"`
+		// Cron standard 5 fields cron spec, takes precedence over Interval
+		Cron string `yaml:"cron" json:"cron"`
+		// Interval duration string, eg. 30s, 15m, 1h
+		Interval string `yaml:"interval" json:"interval"`
+		// Timezone location name the cron spec is evaluated in, local time when empty
+		Timezone string `yaml:"timezone" json:"timezone"`
+		// Enabled scheduler switch, enabled when omitted
+		Enabled *bool `yaml:"enabled" json:"enabled"`
+		// Jitter optional duration string, see Scheduler.JitterMax
+		Jitter string `yaml:"jitter" json:"jitter"`
+		// Misfire optional misfire policy, persists the schedule state when set
+		Misfire string `yaml:"misfire" json:"misfire"`
+	}
+
+	// ScheduleConfig root of the schedules yaml
+	ScheduleConfig struct {
+		Schedules []ScheduleDefinition `yaml:"schedules" json:"schedules"`
+	}
+
+	// ScheduleSource loader of the raw schedules yaml
+	ScheduleSource func() ([]byte, error)
+
+	// ScheduleSet running schedulers built from schedule definitions
+	ScheduleSet struct {
+		mu         sync.Mutex
+		defs       map[string]ScheduleDefinition
+		schedulers map[string]*Scheduler
+		lastSource []byte
+	}
+)
+
+var (
+	taskRegistryMu sync.RWMutex
+	taskRegistry   = map[string]func(context.Context) error{}
+)
+
+// RegisterTask register a task func by name for schedule definitions
+func RegisterTask(name string, handler func(context.Context) error) {
+	taskRegistryMu.Lock()
+	defer taskRegistryMu.Unlock()
+
+	taskRegistry[name] = handler
+}
+
+// GetRegisteredTask get a registered task func by name
+func GetRegisteredTask(name string) (func(context.Context) error, bool) {
+	taskRegistryMu.RLock()
+	defer taskRegistryMu.RUnlock()
+
+	handler, ok := taskRegistry[name]
+	return handler, ok
+}
+
+// LoadSchedules load schedule definitions from yaml data
+func LoadSchedules(yamlData []byte) ([]ScheduleDefinition, error) {
+	var config ScheduleConfig
+	if err := helpers.LoadYamlWStruct(yamlData, &config); err != nil {
+		utils.Error(fmt.Sprintf("[Amagi-Queue] error LoadSchedules: %v", err))
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, def := range config.Schedules {
+		if names[def.Name] {
+			return nil, fmt.Errorf("duplicate schedule name: %v", def.Name)
+		}
+		names[def.Name] = true
+
+		if err := def.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config.Schedules, nil
+}
+
+// FileScheduleSource read the schedules yaml from a file
+func FileScheduleSource(path string) ScheduleSource {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// ConfigctlScheduleSource read the schedules yaml stored in configctl under credKey
+func ConfigctlScheduleSource(credKey, field string) ScheduleSource {
+	return func() ([]byte, error) {
+		resp, err := configctl.APIrequestGetter(credKey, field)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(resp[field]), nil
+	}
+}
+
+// IsEnabled the schedule is enabled unless explicitly disabled
+func (def ScheduleDefinition) IsEnabled() bool {
+	return def.Enabled == nil || *def.Enabled
+}
+
+// TaskName registered task name of the definition
+func (def ScheduleDefinition) TaskName() string {
+	if def.Task != "" {
+		return def.Task
+	}
+
+	return def.Name
+}
+
+// Validate check the definition fields
+func (def ScheduleDefinition) Validate() error {
+	if def.Name == "" {
+		return fmt.Errorf("schedule name is required")
+	}
+	if def.Cron == "" && def.Interval == "" {
+		return fmt.Errorf("schedule %v: cron or interval is required", def.Name)
+	}
+	if def.Cron != "" {
+		if _, err := cron.ParseStandard(def.Cron); err != nil {
+			return fmt.Errorf("schedule %v: invalid cron %q: %v", def.Name, def.Cron, err)
+		}
+	} else if d, err := time.ParseDuration(def.Interval); err != nil || d <= 0 {
+		return fmt.Errorf("schedule %v: invalid interval %q", def.Name, def.Interval)
+	}
+	if _, err := def.location(); err != nil {
+		return fmt.Errorf("schedule %v: invalid timezone %q: %v", def.Name, def.Timezone, err)
+	}
+	if def.Jitter != "" {
+		if _, err := time.ParseDuration(def.Jitter); err != nil {
+			return fmt.Errorf("schedule %v: invalid jitter %q", def.Name, def.Jitter)
+		}
+	}
+	policy, err := ParseMisfirePolicy(def.Misfire)
+	if err != nil {
+		return fmt.Errorf("schedule %v: %v", def.Name, err)
+	}
+	// the missed runs are counted in SchedulerIncrement steps, cron schedules have none
+	if policy == MisfireRunAll && def.Cron != "" {
+		return fmt.Errorf("schedule %v: misfire run_all is not supported with cron, use run_once", def.Name)
+	}
+
+	return nil
+}
+
+// Scheduler build a scheduler for the definition with its registered task, started by Start
+func (def ScheduleDefinition) Scheduler() (*Scheduler, error) {
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	handler, ok := GetRegisteredTask(def.TaskName())
+	if !ok {
+		return nil, fmt.Errorf("schedule %v: task %v is not registered", def.Name, def.TaskName())
+	}
+
+	sc := Exec().Name(def.Name).Tasks(Task{TaskName: def.TaskName(), Handler: handler})
+	if def.Jitter != "" {
+		jitter, _ := time.ParseDuration(def.Jitter)
+		sc.WithJitter(jitter)
+	}
+	if def.Misfire != "" {
+		policy, _ := ParseMisfirePolicy(def.Misfire)
+		sc.PersistState(policy)
+	}
+
+	if def.Cron != "" {
+		schedule, _ := cron.ParseStandard(def.Cron)
+		loc, _ := def.location()
+		return sc.SchedulerDuration(CronDuration(schedule, loc)), nil
+	}
+
+	interval, _ := time.ParseDuration(def.Interval)
+	return sc.Duration(interval), nil
+}
+
+// location location of Timezone, time.Local when empty
+func (def ScheduleDefinition) location() (*time.Location, error) {
+	if def.Timezone == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(def.Timezone)
+}
+
+// CronDuration scheduled duration until the next activation of a cron schedule in loc
+func CronDuration(schedule cron.Schedule, loc *time.Location) func(*Scheduler) time.Duration {
+	return func(sc *Scheduler) time.Duration {
+		now := sc.clock().Now()
+		return schedule.Next(now.In(loc)).Sub(now)
+	}
+}
+
+// Start run the scheduler built by ScheduleDefinition.Scheduler with ctx
+func (s *Scheduler) Start(ctx context.Context) *Scheduler {
+	if s.ScheduledDuration != nil {
+		return s.DoSchedulesContext(ctx)
+	}
+
+	return s.DoContext(ctx)
+}
+
+// NewScheduleSet create an empty schedule set
+func NewScheduleSet() *ScheduleSet {
+	return &ScheduleSet{
+		defs:       map[string]ScheduleDefinition{},
+		schedulers: map[string]*Scheduler{},
+	}
+}
+
+// Apply start new and changed schedules, stop removed, changed and disabled ones
+func (set *ScheduleSet) Apply(defs []ScheduleDefinition) error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	// build all schedulers before touching the running ones, so an invalid config changes nothing
+	wanted := map[string]ScheduleDefinition{}
+	built := map[string]*Scheduler{}
+	for _, def := range defs {
+		if !def.IsEnabled() {
+			continue
+		}
+		wanted[def.Name] = def
+		if current, ok := set.defs[def.Name]; ok && reflect.DeepEqual(current, def) {
+			continue
+		}
+
+		sc, err := def.Scheduler()
+		if err != nil {
+			utils.Error(fmt.Sprintf("[Amagi-Queue] error ScheduleSet.Apply: %v", err))
+			return err
+		}
+		built[def.Name] = sc
+	}
+
+	for name, sc := range set.schedulers {
+		if _, ok := wanted[name]; ok && built[name] == nil {
+			continue
+		}
+		utils.Info(fmt.Sprintf("[Amagi-Queue] stopping schedule %v", name))
+		sc.Stop()
+		delete(set.schedulers, name)
+		delete(set.defs, name)
+	}
+
+	for name, sc := range built {
+		utils.Info(fmt.Sprintf("[Amagi-Queue] starting schedule %v", name))
+		set.defs[name] = wanted[name]
+		set.schedulers[name] = sc.Start(context.Background())
+	}
+
+	return nil
+}
+
+// Load load the definitions from source and apply them if the source changed since the last load
+func (set *ScheduleSet) Load(source ScheduleSource) error {
+	data, err := source()
+	if err != nil {
+		utils.Error(fmt.Sprintf("[Amagi-Queue] error loading schedules: %v", err))
+		return err
+	}
+
+	set.mu.Lock()
+	unchanged := set.lastSource != nil && bytes.Equal(set.lastSource, data)
+	set.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	defs, err := LoadSchedules(data)
+	if err != nil {
+		return err
+	}
+	if err := set.Apply(defs); err != nil {
+		return err
+	}
+
+	set.mu.Lock()
+	set.lastSource = data
+	set.mu.Unlock()
+	return nil
+}
+
+// Watch load the source and reload it every interval until ctx is done,
+// a failing reload keeps the running schedules
+func (set *ScheduleSet) Watch(ctx context.Context, source ScheduleSource, interval time.Duration) error {
+	if err := set.Load(source); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				set.Load(source)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stop all running schedules
+func (set *ScheduleSet) Stop() {
+	set.Apply(nil)
+}
+
+// Schedulers running schedulers by name
+func (set *ScheduleSet) Schedulers() map[string]*Scheduler {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	schedulers := make(map[string]*Scheduler, len(set.schedulers))
+	for name, sc := range set.schedulers {
+		schedulers[name] = sc
+	}
+
+	return schedulers
+}
@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testSchedulesYaml = []byte(`
+schedules:
+  - name: nightly
+    task: testing_task
+    cron: "0 2 * * *"
+    timezone: Asia/Tokyo
+  - name: cleanup
+    task: testing_task
+    interval: 15m
+  - name: disabled
+    task: testing_task
+    interval: 1h
+    enabled: false
+`)
+
+func TestLoadSchedules(t *testing.T) {
+	defs, err := LoadSchedules(testSchedulesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 3 {
+		t.Fatalf("loaded %v schedules, want 3", len(defs))
+	}
+	if defs[2].IsEnabled() || !defs[0].IsEnabled() {
+		t.Errorf("unexpected enabled flags %v %v", defs[0].IsEnabled(), defs[2].IsEnabled())
+	}
+
+	for _, invalid := range []string{
+		"schedules:\n  - name: a\n",
+		"schedules:\n  - name: a\n    cron: \"99 * * * *\"\n",
+		"schedules:\n  - name: a\n    interval: 1m\n    timezone: Nowhere/Land\n",
+		"schedules:\n  - name: a\n    interval: 1m\n  - name: a\n    interval: 2m\n",
+		"schedules:\n  - name: a\n    cron: \"0 2 * * *\"\n    misfire: run_all\n",
+	} {
+		if _, err := LoadSchedules([]byte(invalid)); err == nil {
+			t.Errorf("expected error loading %q", invalid)
+		}
+	}
+
+	if loc, err := defs[1].location(); err != nil || loc != time.Local {
+		t.Errorf("empty timezone must be local time, got %v %v", loc, err)
+	}
+}
+
+func TestScheduleSetApply(t *testing.T) {
+	RegisterTask("testing_task", func(ctx context.Context) error { return nil })
+
+	defs, _ := LoadSchedules(testSchedulesYaml)
+	set := NewScheduleSet()
+	if err := set.Apply(defs); err != nil {
+		t.Fatal(err)
+	}
+	defer set.Stop()
+
+	running := set.Schedulers()
+	if len(running) != 2 || running["nightly"] == nil || running["cleanup"] == nil {
+		t.Fatalf("running schedules %v, want nightly and cleanup", running)
+	}
+
+	defs[1].Interval = "30m"
+	if err := set.Apply(defs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if after := set.Schedulers(); after["nightly"] != running["nightly"] || after["cleanup"] == running["cleanup"] {
+		t.Errorf("only the changed schedule should be restarted")
+	}
+
+	if err := set.Apply([]ScheduleDefinition{{Name: "unknown", Task: "not_registered", Interval: "1m"}}); err == nil {
+		t.Error("expected error for unregistered task")
+	}
+	if len(set.Schedulers()) != 2 {
+		t.Error("failed apply must keep the running schedules")
+	}
+}
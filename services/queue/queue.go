@@ -99,11 +99,10 @@ func (item *Queue) Enqueue(callback func(Queue)) error {
 	en := gob.NewEncoder(&data)
 	if err := en.Encode(&item.ItemExec); err != nil {
 		utils.Error(fmt.Sprintf("[Amagi-Queue] error Encoding to GOB: %v", err))
-		return err
+		return fmt.Errorf("error encoding %T to GOB, register it with gob.Register: %v", item.ItemExec, err)
 	}
-	sc := database.SessionCopy()
-	defer sc.Close()
-	coll := sc.DB(database.Db).C(QueueCollection)
+	conn := database.BeginMongoWCol()(QueueCollection)
+	defer conn.Conn.Close()
 
 	item.ItemData = data.Bytes()
 	item.ID = bson.NewObjectId()
@@ -124,7 +123,9 @@ func (item *Queue) Enqueue(callback func(Queue)) error {
 	}
 	item.ItemIdentity = fmt.Sprintf("task_%s_%s", item.ItemType, ident)
 
-	if err := coll.Insert(item); err != nil {
+	err := conn.Col.Insert(item)
+	conn.Record("enqueue", nil, err)
+	if err != nil {
 		utils.Error(fmt.Sprintf("[Amagi-Queue] error Enqueue: %v", err))
 		return err
 	}
@@ -143,9 +144,8 @@ func (item *Queue) Enqueue(callback func(Queue)) error {
 //     fmt.Print(queueItem.Status)
 //
 func (item *Queue) Dequeue(typeName string, callback func(interface{})) error {
-	sc := database.SessionCopy()
-	defer sc.Close()
-	coll := sc.DB(database.Db).C(QueueCollection)
+	conn := database.BeginMongoWCol()(QueueCollection)
+	defer conn.Conn.Close()
 
 	change := mgo.Change{
 		Update: bson.M{"$set": bson.M{
@@ -160,7 +160,9 @@ func (item *Queue) Dequeue(typeName string, callback func(interface{})) error {
 		selector["item_type"] = typeName
 	}
 
-	if _, err := coll.Find(selector).Sort("created_at").Apply(change, item); err != nil {
+	_, err := conn.Col.Find(selector).Sort("created_at").Apply(change, item)
+	conn.Record("dequeue", selector, err)
+	if err != nil {
 		if err != mgo.ErrNotFound {
 			// Do not print error message if none found
 			utils.Error(fmt.Sprintf("[Amagi-Queue] error Dequeue: %v", err))
@@ -231,16 +233,17 @@ func (item *Queue) CleanUp() {
 
 func (item *Queue) updateQueue(status Statuses) error {
 
-	sc := database.SessionCopy()
-	defer sc.Close()
-	coll := sc.DB(database.Db).C(QueueCollection)
+	conn := database.BeginMongoWCol()(QueueCollection)
+	defer conn.Conn.Close()
 
 	query := bson.M{"_id": item.ID}
 	update := bson.M{"$set": bson.M{
 		"status":      status,
 		"finished_at": time.Now(),
 	}}
-	if err := coll.Update(query, update); err != nil {
+	err := conn.Col.Update(query, update)
+	conn.Record("updateQueue", query, err)
+	if err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,204 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/services/database"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// MisfirePolicy what to do with the runs missed while the scheduler was down
+	MisfirePolicy int
+
+	// ScheduleState persisted execution state of a scheduled task
+	ScheduleState struct {
+		ID            string    `bson:"_id"`
+		Scheduler     string    `bson:"scheduler"`
+		TaskName      string    `bson:"task_name"`
+		LastExecution time.Time `bson:"last_execution"`
+		NextExecution time.Time `bson:"next_execution"`
+		UpdatedAt     time.Time `bson:"updated_at"`
+	}
+)
+
+const (
+	// MisfireSkip ignore missed runs and wait for the next schedule
+	MisfireSkip MisfirePolicy = iota
+	// MisfireRunOnce run the task once if one or more runs were missed
+	MisfireRunOnce
+	// MisfireRunAll run the task once for every missed run
+	MisfireRunAll
+)
+
+var (
+	// ScheduleStateCollection collection name of the persisted schedule state
+	ScheduleStateCollection = "queue_schedule_state"
+
+	// MaxMisfireRuns upper limit of missed runs executed with MisfireRunAll
+	MaxMisfireRuns = 100
+)
+
+// ParseMisfirePolicy parse misfire policy from string (skip, run_once, run_all)
+func ParseMisfirePolicy(policy string) (MisfirePolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "skip":
+		return MisfireSkip, nil
+	case "run_once", "once":
+		return MisfireRunOnce, nil
+	case "run_all", "all":
+		return MisfireRunAll, nil
+	}
+
+	return MisfireSkip, fmt.Errorf("invalid misfire policy: %v", policy)
+}
+
+func (policy MisfirePolicy) String() string {
+	names := []string{
+		"MisfireSkip",
+		"MisfireRunOnce",
+		"MisfireRunAll",
+	}
+	if policy < 0 || int(policy) >= len(names) {
+		return fmt.Sprintf("MisfirePolicy(%d)", int(policy))
+	}
+
+	return names[policy]
+}
+
+// GetScheduleState get the persisted state of a task from a named scheduler
+func GetScheduleState(scheduler, taskName string) (ScheduleState, error) {
+	conn := database.BeginMongoWCol()(ScheduleStateCollection)
+	defer conn.Conn.Close()
+
+	var state ScheduleState
+	err := conn.Col.FindId(scheduleStateID(scheduler, taskName)).One(&state)
+	conn.Record("getScheduleState", nil, err)
+	if err != nil {
+		return state, err
+	}
+
+	return state, nil
+}
+
+func setScheduleState(scheduler, taskName string, fields bson.M) error {
+	conn := database.BeginMongoWCol()(ScheduleStateCollection)
+	defer conn.Conn.Close()
+
+	fields["scheduler"] = scheduler
+	fields["task_name"] = taskName
+	fields["updated_at"] = time.Now()
+	_, err := conn.Col.UpsertId(scheduleStateID(scheduler, taskName), bson.M{"$set": fields})
+	conn.Record("setScheduleState", nil, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("[Amagi-Queue] error setScheduleState %v/%v: %v", scheduler, taskName, err))
+		return err
+	}
+
+	return nil
+}
+
+func scheduleStateID(scheduler, taskName string) string {
+	return fmt.Sprintf("%v:%v", scheduler, taskName)
+}
+
+// PersistState persist task executions to ScheduleStateCollection and apply
+// the misfire policy to runs missed while the scheduler was down, requires Name
+func (s *Scheduler) PersistState(policy MisfirePolicy) *Scheduler {
+	s.Persist = true
+	s.Misfire = policy
+
+	return s
+}
+
+// persistExecution store the last execution of a task, and its next one when running on an interval
+func (s *Scheduler) persistExecution(taskName string, last time.Time) {
+	if !s.Persist {
+		return
+	}
+
+	fields := bson.M{"last_execution": last}
+	if s.IntervalDuration > 0 {
+		fields["next_execution"] = last.Add(s.IntervalDuration)
+	}
+	setScheduleState(s.MainTaskName, taskName, fields)
+}
+
+// persistNextExecution store the next planned execution of a task
+func (s *Scheduler) persistNextExecution(taskName string, next time.Time) {
+	if !s.Persist {
+		return
+	}
+
+	setScheduleState(s.MainTaskName, taskName, bson.M{"next_execution": next})
+}
+
+// catchUpTask apply the misfire policy for a task from its persisted state and return
+// the time the schedule resumes from: the last missed run, or the pending next execution
+// if it is still in the future. Zero time if there is nothing persisted
+func (s *Scheduler) catchUpTask(ctx context.Context, t *Task, increment time.Duration) time.Time {
+	if !s.Persist {
+		return time.Time{}
+	}
+
+	state, err := GetScheduleState(s.MainTaskName, t.TaskName)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			utils.Error(fmt.Sprintf("[Amagi-Queue] error loading schedule state %v/%v: %v", s.MainTaskName, t.TaskName, err))
+		}
+		return time.Time{}
+	}
+	next := state.NextExecution
+	if next.IsZero() {
+		return time.Time{}
+	}
+	// the pending run was executed before the next one got persisted
+	if !state.LastExecution.Before(next) {
+		if increment <= 0 {
+			return time.Time{}
+		}
+		next = next.Add(increment)
+	}
+
+	now := s.clock().Now()
+	if next.After(now) {
+		return next
+	}
+
+	missed := missedRuns(next, now, increment)
+	utils.Info(fmt.Sprintf("[Amagi-Queue] task %v/%v missed %v run(s) since %v, policy=%v",
+		s.MainTaskName, t.TaskName, len(missed), next, s.Misfire))
+
+	runs := 0
+	switch s.Misfire {
+	case MisfireRunOnce:
+		runs = 1
+	case MisfireRunAll:
+		runs = len(missed)
+	}
+	for i := 0; i < runs && ctx.Err() == nil; i++ {
+		s.runTask(ctx, t)
+	}
+
+	return missed[len(missed)-1]
+}
+
+// missedRuns list the scheduled runs from next until now with increment,
+// at most MaxMisfireRuns and at least the one at next
+func missedRuns(next, now time.Time, increment time.Duration) []time.Time {
+	runs := []time.Time{next}
+	if increment <= 0 {
+		return runs
+	}
+
+	for run := next.Add(increment); !run.After(now) && len(runs) < MaxMisfireRuns; run = run.Add(increment) {
+		runs = append(runs, run)
+	}
+
+	return runs
+}
@@ -0,0 +1,109 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/services/database"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// ScheduledItem queue item template enqueued by a scheduled task,
+	// the execution is left to the dequeuer and its loggers
+	ScheduledItem struct {
+		// NewExec builds the Executor to enqueue on every run. Executors are gob-encoded,
+		// their concrete type must be registered with gob.Register
+		NewExec  func() Executor
+		Category string
+		MetaData interface{}
+
+		// SkipIfPending do not enqueue while an item of the same type and category is queued or in progress
+		SkipIfPending bool
+	}
+)
+
+// EnqueueTask create a Task that enqueues the scheduled item on every run
+//
+// For example:
+//
+//	Exec().Duration(Hourly).Tasks(
+//	    EnqueueTask("reindex", ScheduledItem{NewExec: func() Executor { return &Reindex{} }}),
+//	).Do()
+func EnqueueTask(taskName string, item ScheduledItem) Task {
+	return Task{
+		TaskName: taskName,
+		Handler: func(ctx context.Context) error {
+			return item.enqueue()
+		},
+	}
+}
+
+// Enqueue add a task that enqueues the scheduled item on every run, the Executor of
+// NewExec must be registered with gob.Register
+func (s *Scheduler) Enqueue(taskName string, item ScheduledItem) *Scheduler {
+	return s.Tasks(EnqueueTask(taskName, item))
+}
+
+func (item ScheduledItem) enqueue() error {
+	if item.NewExec == nil {
+		return fmt.Errorf("ScheduledItem must have NewExec")
+	}
+
+	queueItem := Queue{
+		ItemExec: item.NewExec(),
+		Category: item.Category,
+		MetaData: item.MetaData,
+	}
+	if item.SkipIfPending {
+		pending, err := hasPendingItem(pendingSelector(queueItem))
+		if err != nil {
+			return err
+		}
+		if pending {
+			utils.Info(fmt.Sprintf("[Amagi-Queue] skipped scheduled `%v`, an item is still pending", queueItem.ExecName()))
+			return nil
+		}
+	}
+
+	return queueItem.Enqueue(nil)
+}
+
+// HasPendingItem check if an item of type and category is queued or in progress
+func HasPendingItem(itemType, category string) (bool, error) {
+	return hasPendingItem(pendingItemSelector(itemType, category))
+}
+
+// pendingSelector selector of the pending items like queueItem, the category defaulting
+// to the executor name as in Enqueue
+func pendingSelector(queueItem Queue) bson.M {
+	category := queueItem.Category
+	if category == "" {
+		category = queueItem.ExecName()
+	}
+
+	return pendingItemSelector(queueItem.ExecName(), category)
+}
+
+func pendingItemSelector(itemType, category string) bson.M {
+	return bson.M{
+		"item_type": itemType,
+		"category":  category,
+		"status":    bson.M{"$in": []Statuses{StatusQueued, StatusProgress}},
+	}
+}
+
+func hasPendingItem(selector bson.M) (bool, error) {
+	conn := database.BeginMongoWCol()(QueueCollection)
+	defer conn.Conn.Close()
+
+	count, err := conn.Col.Find(selector).Count()
+	conn.Record("hasPendingItem", selector, err)
+	if err != nil {
+		utils.Error(fmt.Sprintf("[Amagi-Queue] error HasPendingItem: %v", err))
+		return false, err
+	}
+
+	return count > 0, nil
+}
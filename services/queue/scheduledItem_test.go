@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type reindexExec struct{}
+
+func (e *reindexExec) Execute(Logificator) error { return nil }
+func (e *reindexExec) Identity() string          { return "reindex" }
+
+func TestEnqueueTaskWithoutNewExec(t *testing.T) {
+	task := EnqueueTask("reindex", ScheduledItem{Category: "search"})
+	if task.TaskName != "reindex" {
+		t.Errorf("TaskName=%v", task.TaskName)
+	}
+	if err := task.Handler(context.Background()); err == nil {
+		t.Error("enqueueing without NewExec must fail")
+	}
+
+	s := Exec().Enqueue("reindex", ScheduledItem{})
+	if len(s.TaskHandlers) != 1 {
+		t.Fatalf("TaskHandlers=%v", len(s.TaskHandlers))
+	}
+	if err := s.TaskHandlers[0].Handler(context.Background()); err == nil {
+		t.Error("Scheduler.Enqueue without NewExec must fail")
+	}
+}
+
+func TestEnqueueUnregisteredExec(t *testing.T) {
+	task := EnqueueTask("reindex", ScheduledItem{NewExec: func() Executor { return &reindexExec{} }})
+	err := task.Handler(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "*queue.reindexExec") || !strings.Contains(err.Error(), "gob.Register") {
+		t.Errorf("expected the unregistered type in the error, got %v", err)
+	}
+}
+
+func TestPendingSelector(t *testing.T) {
+	item := Queue{ItemExec: &reindexExec{}}
+	name := item.ExecName()
+
+	selector := pendingSelector(item)
+	if selector["item_type"] != name || selector["category"] != name {
+		t.Errorf("category must default to the executor name %v: %v", name, selector)
+	}
+
+	item.Category = "search"
+	selector = pendingSelector(item)
+	if selector["category"] != "search" {
+		t.Errorf("category=%v", selector["category"])
+	}
+	if status, ok := selector["status"].(bson.M); !ok || status["$in"] == nil {
+		t.Errorf("status=%v", selector["status"])
+	}
+}
@@ -1,9 +1,12 @@
 package queue
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/b-eee/amagi/helpers"
@@ -35,10 +38,38 @@ type (
 		SchedulerTimeMinute string
 		SchedulerIncrement  time.Duration
 
+		// ParallelTasks run the tasks of a tick in parallel, capped by MaxConcurrency
+		ParallelTasks  bool
+		MaxConcurrency int
+
+		// Persist store task executions in ScheduleStateCollection, Misfire is applied on start
+		Persist bool
+		Misfire MisfirePolicy
+
+		// JitterMax random delay up to the duration added before the first tick of Do
+		// and before every run of DoSchedules, to avoid thundering herds across replicas
+		JitterMax time.Duration
+		// Clock time source of the scheduler, RealClock when nil
+		Clock Clock
+
 		Quit chan int
+
+		statsMu sync.RWMutex
+		stats   map[string]*TaskStats
+
+		startMu sync.Mutex
+		cancel  context.CancelFunc
+		running sync.WaitGroup
 	}
 )
 
+// Name set the scheduler name, used as key of the persisted schedule state
+func (s *Scheduler) Name(name string) *Scheduler {
+	s.MainTaskName = name
+
+	return s
+}
+
 // Duration the interval duration for the task to execute
 func (s *Scheduler) Duration(duration time.Duration) *Scheduler {
 	s.IntervalDuration = duration
@@ -76,6 +107,54 @@ func (s *Scheduler) Tasks(task ...Task) *Scheduler {
 	return s
 }
 
+// Parallel run the tasks of each tick in parallel with at most maxConcurrency tasks at a time,
+// maxConcurrency <= 0 means no limit
+func (s *Scheduler) Parallel(maxConcurrency int) *Scheduler {
+	s.ParallelTasks = true
+	s.MaxConcurrency = maxConcurrency
+
+	return s
+}
+
+// WithJitter add a random delay up to max before running, see JitterMax
+func (s *Scheduler) WithJitter(max time.Duration) *Scheduler {
+	s.JitterMax = max
+
+	return s
+}
+
+// WithClock set the clock the scheduler runs on
+func (s *Scheduler) WithClock(clock Clock) *Scheduler {
+	s.Clock = clock
+
+	return s
+}
+
+// Stop stop the scheduler and wait for the running tasks to return, it can be started again after
+func (s *Scheduler) Stop() {
+	s.startMu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.startMu.Unlock()
+
+	s.running.Wait()
+}
+
+// TaskStats get the last execution results of a task by name
+func (s *Scheduler) TaskStats(taskName string) (TaskStats, bool) {
+	s.statsMu.RLock()
+	defer s.statsMu.RUnlock()
+
+	stats, ok := s.stats[taskName]
+	if !ok {
+		return TaskStats{}, false
+	}
+
+	return *stats, true
+}
+
 // LoopDuration loop duration getter from ENV
 func LoopDuration(envName string) time.Duration {
 	defaultLoopDuration := 60 * SecondsMultiplier
@@ -88,20 +167,35 @@ func LoopDuration(envName string) time.Duration {
 
 // Do do scheduler task
 func (s *Scheduler) Do() *Scheduler {
+	return s.DoContext(context.Background())
+}
+
+// DoContext do scheduler task until ctx is done, Quit receives or Stop is called
+func (s *Scheduler) DoContext(ctx context.Context) *Scheduler {
+	ctx, ok := s.start(ctx)
+	if !ok {
+		return s
+	}
 	utils.Info(fmt.Sprintf("task %v started..  interval=%v", s.MainTaskName, s.IntervalDuration))
-	ticker := time.NewTicker(s.IntervalDuration)
 
+	s.running.Add(1)
 	go func() {
+		defer s.running.Done()
+		if !s.sleep(ctx, s.jitter()) {
+			return
+		}
+
+		for i := range s.TaskHandlers {
+			s.catchUpTask(ctx, &s.TaskHandlers[i], s.IntervalDuration)
+		}
+
+		ticker := s.clock().NewTicker(s.IntervalDuration)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				// run all tasks from main task in sync
-				// TODO TO RUN ALL TASKS FROM MAIN TASK IN PARALLEL? -JP
-				for _, t := range s.TaskHandlers {
-					t.Exec()
-				}
-			case <-s.Quit:
-				ticker.Stop()
+			case <-ticker.C():
+				s.runTasks(ctx)
+			case <-ctx.Done():
 				return
 			}
 		}
@@ -112,17 +206,44 @@ func (s *Scheduler) Do() *Scheduler {
 
 // DoSchedules do task from a specified main schedule
 func (s *Scheduler) DoSchedules() *Scheduler {
+	return s.DoSchedulesContext(context.Background())
+}
+
+// DoSchedulesContext do task from a specified main schedule until ctx is done, Quit receives or Stop is called.
+// Each task has its own LastExecution, ScheduledDuration receives a per task copy of the schedule
+func (s *Scheduler) DoSchedulesContext(ctx context.Context) *Scheduler {
+	ctx, ok := s.start(ctx)
+	if !ok {
+		return s
+	}
+
 	for _, t := range s.TaskHandlers {
+		s.running.Add(1)
 		go func(task Task) {
-			for {
+			defer s.running.Done()
+			schedule := s.taskSchedule()
+
+			// resume from the persisted state, waiting for a pending run that is still due
+			if resumeAt := s.catchUpTask(ctx, &task, s.SchedulerIncrement); !resumeAt.IsZero() {
+				if wait := resumeAt.Sub(s.clock().Now()); wait > 0 {
+					if !s.sleep(ctx, wait) {
+						return
+					}
+					s.runTask(ctx, &task)
+				}
+				schedule.LastExecution = resumeAt
+			}
 
-				sleepTime := s.ScheduledDuration(s)
-				// ss := time.Until(sleepTime)
-				if s.LastExecution != (time.Time{}) {
-					fmt.Printf("next execution for task is %v or %v========\n", helpers.TimeToStr(s.LastExecution), sleepTime)
+			for {
+				sleepTime := s.ScheduledDuration(schedule)
+				if schedule.LastExecution != (time.Time{}) {
+					utils.Info(fmt.Sprintf("next execution for task %v is %v in %v", task.TaskName, helpers.TimeToStr(schedule.LastExecution), sleepTime))
+				}
+				s.persistNextExecution(task.TaskName, s.clock().Now().Add(sleepTime))
+				if !s.sleep(ctx, sleepTime+s.jitter()) {
+					return
 				}
-				time.Sleep(sleepTime)
-				task.Exec()
+				s.runTask(ctx, &task)
 			}
 		}(t)
 	}
@@ -130,9 +251,150 @@ func (s *Scheduler) DoSchedules() *Scheduler {
 	return s
 }
 
+// taskSchedule copy of the schedule settings holding the LastExecution of a single task
+func (s *Scheduler) taskSchedule() *Scheduler {
+	return &Scheduler{
+		IntervalDuration:    s.IntervalDuration,
+		ScheduledDuration:   s.ScheduledDuration,
+		LastExecution:       s.LastExecution,
+		MainTaskName:        s.MainTaskName,
+		SchedulerTimeHour:   s.SchedulerTimeHour,
+		SchedulerTimeMinute: s.SchedulerTimeMinute,
+		SchedulerIncrement:  s.SchedulerIncrement,
+		Clock:               s.Clock,
+	}
+}
+
+// start derive the scheduler context, cancelled by Stop or by a receive on Quit.
+// false when the scheduler is already running
+func (s *Scheduler) start(parent context.Context) (context.Context, bool) {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if s.cancel != nil {
+		utils.Error(fmt.Sprintf("task %v already started, Stop it before starting it again", s.MainTaskName))
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	s.cancel = cancel
+
+	if s.Quit != nil {
+		go func() {
+			select {
+			case <-s.Quit:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, true
+}
+
+// sleep wait for the duration on the scheduler clock, false if the scheduler was stopped meanwhile
+func (s *Scheduler) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-s.clock().After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.JitterMax <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(s.JitterMax)))
+}
+
+func (s *Scheduler) clock() Clock {
+	if s.Clock == nil {
+		return RealClock
+	}
+
+	return s.Clock
+}
+
+// runTasks run all tasks of a tick, in sync unless ParallelTasks is set
+func (s *Scheduler) runTasks(ctx context.Context) {
+	if !s.ParallelTasks {
+		for i := range s.TaskHandlers {
+			s.runTask(ctx, &s.TaskHandlers[i])
+		}
+		return
+	}
+
+	limit := s.MaxConcurrency
+	if limit <= 0 || limit > len(s.TaskHandlers) {
+		limit = len(s.TaskHandlers)
+	}
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := range s.TaskHandlers {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(t *Task) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.runTask(ctx, t)
+		}(&s.TaskHandlers[i])
+	}
+	wg.Wait()
+}
+
+// runTask execute a single task and record its stats
+func (s *Scheduler) runTask(ctx context.Context, t *Task) error {
+	start := s.clock().Now()
+	err := t.ExecContext(ctx)
+	s.recordRun(t.TaskName, start, err)
+	s.persistExecution(t.TaskName, start)
+
+	if err != nil {
+		utils.Error(fmt.Sprintf("task %v failed took: %v err=%v", t.TaskName, s.clock().Now().Sub(start), err))
+		return err
+	}
+
+	utils.Info(fmt.Sprintf("task %v done took: %v", t.TaskName, s.clock().Now().Sub(start)))
+	return nil
+}
+
+func (s *Scheduler) recordRun(taskName string, start time.Time, err error) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if s.stats == nil {
+		s.stats = make(map[string]*TaskStats)
+	}
+	stats, ok := s.stats[taskName]
+	if !ok {
+		stats = &TaskStats{}
+		s.stats[taskName] = stats
+	}
+
+	stats.Runs++
+	stats.LastDuration = s.clock().Now().Sub(start)
+	stats.LastError = err
+	if err != nil {
+		stats.Failures++
+		stats.LastFailure = start
+		return
+	}
+	stats.LastSuccess = start
+}
+
 // TaskTimeGen generate increment timer
 func TaskTimeGen(sc *Scheduler) time.Duration {
-	s := time.Now()
+	now := sc.clock().Now()
+	s := now
 	hour, _ := strconv.Atoi(sc.SchedulerTimeHour)
 	min, _ := strconv.Atoi(sc.SchedulerTimeMinute)
 	target := time.Date(s.Year(), s.Month(), s.Day(), hour, min, 0, 0, time.FixedZone("Asia/Tokyo", 9*60*60))
@@ -150,5 +412,5 @@ func TaskTimeGen(sc *Scheduler) time.Duration {
 	}
 
 	sc.LastExecution = s
-	return time.Until(target)
+	return target.Sub(now)
 }
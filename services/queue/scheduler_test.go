@@ -1,33 +1,221 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestDoSchedules(t *testing.T) {
-	q := make(chan int)
+	tokyo := time.FixedZone("Asia/Tokyo", 9*60*60)
+	clock := NewFakeClock(time.Date(2019, 1, 1, 20, 0, 0, 0, tokyo))
+	ran := make(chan time.Time, 1)
 	sampleTask := Task{
 		TaskName: "test",
-		Task:     testingDo,
+		Handler: func(ctx context.Context) error {
+			ran <- clock.Now()
+			return nil
+		},
 	}
 
 	os.Setenv("TestHour", "20")
 	os.Setenv("TestMin", "15")
 
-	Exec().SetHourMinute(os.Getenv("TestHour"), os.Getenv("TestMin")).SchedulerDuration(TaskTimeGen).Tasks(
+	sc := Exec().WithClock(clock).SetHourMinute(os.Getenv("TestHour"), os.Getenv("TestMin")).SchedulerDuration(TaskTimeGen).SetSchedulerIncrement(Daily).Tasks(
 		sampleTask,
 	).DoSchedules()
+	defer sc.Stop()
 
+	clock.BlockUntil(1)
+	clock.Advance(14 * time.Minute)
+	select {
+	case at := <-ran:
+		t.Fatalf("task ran early at %v", at)
+	default:
+	}
+
+	clock.Advance(time.Minute)
+	if at := <-ran; !at.Equal(time.Date(2019, 1, 1, 20, 15, 0, 0, tokyo)) {
+		t.Errorf("task ran at %v, want 20:15", at)
+	}
+}
+
+func TestDoSchedulesPerTaskLastExecution(t *testing.T) {
+	clock := NewFakeClock(time.Date(2019, 1, 1, 20, 0, 0, 0, time.UTC))
+	ran := make(chan string, 4)
+	handler := func(name string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			ran <- name
+			return nil
+		}
+	}
+
+	// every run of a task moves only its own next execution
+	sc := Exec().WithClock(clock).SchedulerDuration(func(sc *Scheduler) time.Duration {
+		if sc.LastExecution.IsZero() {
+			sc.LastExecution = clock.Now()
+		}
+		sc.LastExecution = sc.LastExecution.Add(Hourly)
+		return sc.LastExecution.Sub(clock.Now())
+	}).Tasks(
+		Task{TaskName: "a", Handler: handler("a")},
+		Task{TaskName: "b", Handler: handler("b")},
+	).DoSchedules()
+	defer sc.Stop()
+
+	clock.BlockUntil(2)
+	clock.Advance(Hourly)
+	got := map[string]bool{<-ran: true, <-ran: true}
+	if !got["a"] || !got["b"] {
+		t.Errorf("ran=%v, want both tasks after an hour", got)
+	}
+}
+
+func TestDoStartedTwice(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	sc := Exec().WithClock(clock).Duration(Minute).Tasks(Task{TaskName: "tick", Handler: func(ctx context.Context) error { return nil }})
+	sc.Do()
+	sc.Do()
+
+	done := make(chan struct{})
 	go func() {
-		time.Sleep(5 * time.Minute)
-		q <- 1
+		sc.Stop()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop hangs after a second start")
+	}
+
+	// restarted after Stop
+	sc.Do()
+	sc.Stop()
+}
+
+func TestDoStop(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ran := make(chan struct{}, 1)
+	quit := make(chan int)
+	sc := Exec().WithClock(clock).Duration(Minute).Tasks(Task{
+		TaskName: "tick",
+		Handler: func(ctx context.Context) error {
+			ran <- struct{}{}
+			return nil
+		},
+	})
+	sc.Quit = quit
+	sc.Do()
+
+	clock.BlockUntil(1)
+	for i := 0; i < 3; i++ {
+		clock.Advance(Minute)
+		<-ran
+	}
+
+	quit <- 1
+	sc.Stop()
+	if stats, _ := sc.TaskStats("tick"); stats.Runs != 3 {
+		t.Errorf("runs=%v, want 3", stats.Runs)
+	}
+}
+
+func TestRunTasksRecoversPanic(t *testing.T) {
+	sc := Exec().Tasks(
+		Task{TaskName: "panics", Task: func() { panic("boom") }},
+		Task{TaskName: "fails", Handler: func(ctx context.Context) error { return fmt.Errorf("failed") }},
+		Task{TaskName: "ok", Handler: func(ctx context.Context) error { return nil }},
+	)
+	sc.runTasks(context.Background())
+
+	for name, wantErr := range map[string]bool{"panics": true, "fails": true, "ok": false} {
+		stats, ok := sc.TaskStats(name)
+		if !ok {
+			t.Fatalf("no stats recorded for %v", name)
+		}
+		if stats.Runs != 1 {
+			t.Errorf("%v runs=%v, want 1", name, stats.Runs)
+		}
+		if (stats.LastError != nil) != wantErr {
+			t.Errorf("%v LastError=%v, want error=%v", name, stats.LastError, wantErr)
+		}
+		if wantErr && stats.LastFailure.IsZero() {
+			t.Errorf("%v LastFailure not set", name)
+		}
+		if !wantErr && stats.LastSuccess.IsZero() {
+			t.Errorf("%v LastSuccess not set", name)
+		}
+	}
+}
 
-	<-q
+func TestRunTasksParallelLimit(t *testing.T) {
+	var running, maxRunning int32
+	task := func(ctx context.Context) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	sc := Exec().Parallel(2)
+	for i := 0; i < 6; i++ {
+		sc.Tasks(Task{TaskName: fmt.Sprintf("task_%v", i), Handler: task})
+	}
+	sc.runTasks(context.Background())
+
+	if maxRunning != 2 {
+		t.Errorf("max concurrent tasks=%v, want 2", maxRunning)
+	}
+}
+
+func TestMissedRuns(t *testing.T) {
+	next := time.Date(2019, 1, 1, 2, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		now       time.Time
+		increment time.Duration
+		want      int
+	}{
+		{next, Daily, 1},
+		{next.Add(3 * time.Hour), Hourly, 4},
+		{next.Add(50 * time.Hour), Daily, 3},
+		{next.Add(50 * time.Hour), 0, 1},
+		{next.Add(1000 * time.Hour), Hourly, MaxMisfireRuns},
+	}
+
+	for _, c := range cases {
+		runs := missedRuns(next, c.now, c.increment)
+		if len(runs) != c.want {
+			t.Errorf("missedRuns(%v, %v)=%v runs, want %v", c.now, c.increment, len(runs), c.want)
+		}
+		if !runs[0].Equal(next) {
+			t.Errorf("first missed run=%v, want %v", runs[0], next)
+		}
+	}
+}
+
+func TestParseMisfirePolicy(t *testing.T) {
+	for str, want := range map[string]MisfirePolicy{"": MisfireSkip, "skip": MisfireSkip, "run_once": MisfireRunOnce, "RUN_ALL": MisfireRunAll} {
+		if policy, err := ParseMisfirePolicy(str); err != nil || policy != want {
+			t.Errorf("ParseMisfirePolicy(%q)=%v,%v want %v", str, policy, err, want)
+		}
+	}
+	if _, err := ParseMisfirePolicy("sometimes"); err == nil {
+		t.Error("expected error for invalid policy")
+	}
+	if str := MisfirePolicy(7).String(); str != "MisfirePolicy(7)" {
+		t.Errorf("out of range policy String()=%v", str)
+	}
 }
 
 func testingDo() {
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -13,6 +14,9 @@ var (
 
 	// MinutesMultiplier minute multiplier for duration
 	MinutesMultiplier = 1 * time.Minute
+
+	// ErrNoTaskHandler task has neither Handler nor Task set
+	ErrNoTaskHandler = fmt.Errorf("task has no Handler or Task func")
 )
 
 type (
@@ -21,14 +25,47 @@ type (
 		TaskName string
 		Task     func()
 
+		// Handler context aware task func, takes precedence over Task when set
+		Handler func(context.Context) error
+
 		Quit chan int
 	}
+
+	// TaskStats last execution results of a scheduled task
+	TaskStats struct {
+		LastSuccess  time.Time
+		LastFailure  time.Time
+		LastDuration time.Duration
+		LastError    error
+		Runs         int
+		Failures     int
+	}
 )
 
 // Exec task execution
-func (t *Task) Exec() {
+func (t *Task) Exec() error {
+	return t.ExecContext(context.Background())
+}
+
+// ExecContext task execution with context, a panic inside the task is recovered and returned as error
+func (t *Task) ExecContext(ctx context.Context) (err error) {
 	utils.Info(fmt.Sprintf("executing task for [%v]", t.TaskName))
 
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task [%v] panicked: %v", t.TaskName, r)
+			utils.Error(fmt.Sprintf("%v", err))
+		}
+	}()
+
 	// execute specified task
-	t.Task()
+	switch {
+	case t.Handler != nil:
+		return t.Handler(ctx)
+	case t.Task != nil:
+		t.Task()
+		return nil
+	}
+
+	return ErrNoTaskHandler
 }
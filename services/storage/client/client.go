@@ -9,6 +9,7 @@ import (
 	"github.com/b-eee/amagi/services/configctl"
 	"github.com/b-eee/amagi/services/storage"
 	"github.com/b-eee/amagi/services/storage/gcs"
+	"github.com/b-eee/amagi/services/storage/gridfs"
 	"github.com/b-eee/amagi/services/storage/minio"
 )
 
@@ -62,6 +63,13 @@ func InitStorageClient() {
 			BucketName: os.Getenv(BucketNameEnv),
 			PublicPath: os.Getenv(PublicNameEnv),
 		}
+	case "gridfs":
+		// the mongodb session must be started before
+		Client = &gridfs.Service{
+			Database:   cfg["database"],
+			BucketName: os.Getenv(BucketNameEnv),
+			PublicPath: os.Getenv(PublicNameEnv),
+		}
 	default:
 		panic(fmt.Errorf("Invalid storage service: %s", cfg["storageService"]))
 	}
@@ -0,0 +1,259 @@
+package gridfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	utils "github.com/b-eee/amagi"
+	"github.com/b-eee/amagi/helpers"
+	"github.com/b-eee/amagi/services/database"
+	"github.com/b-eee/amagi/services/storage"
+
+	mgo "github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// Service storage on the GridFS of the mongodb session, BucketName is the GridFS prefix
+	Service struct {
+		Database   string
+		BucketName string
+		PublicPath string
+		Region     string
+		Endpoint   string
+	}
+)
+
+var (
+	// DefaultBucketName GridFS prefix when no bucket is configured
+	DefaultBucketName = "fs"
+)
+
+// GetBucketName return bucket name
+func (svc *Service) GetBucketName() string {
+	return svc.BucketName
+}
+
+// GetPublicPath return GetPublicPath
+func (svc *Service) GetPublicPath() string {
+	return svc.PublicPath
+}
+
+// GetRegion return GetRegion
+func (svc *Service) GetRegion() string {
+	return svc.Region
+}
+
+// GetEndpoint return GetEndpoint
+func (svc *Service) GetEndpoint() string {
+	return svc.Endpoint
+}
+
+// Initialize initialize service, requires a started mongodb session
+func (svc *Service) Initialize() error {
+	if !database.IsConnected() {
+		return fmt.Errorf("GridFS storage requires a mongodb session")
+	}
+	if svc.BucketName == "" {
+		svc.BucketName = DefaultBucketName
+	}
+	if svc.PublicPath == "" {
+		return fmt.Errorf("Invalid service struct: %v", svc)
+	}
+
+	sc, gfs := svc.begin()
+	defer sc.Close()
+
+	return ensureIndexes(gfs)
+}
+
+// NewObject base method in creating objects, replacing the previous object of the same name
+func (svc *Service) NewObject(objectName string, file io.Reader, contentType string) (*storage.ObjectInfo, error) {
+	sc, gfs := svc.begin()
+	defer sc.Close()
+
+	f, err := gfs.Create(objectName)
+	if err != nil {
+		utils.Error(fmt.Sprintf("GridFS.Create failed: %v", err))
+		return nil, err
+	}
+	f.SetContentType(contentType)
+
+	if _, err := io.Copy(f, file); err != nil {
+		f.Abort()
+		f.Close()
+		utils.Error(fmt.Sprintf("GridFS write failed: %v", err))
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		utils.Error(fmt.Sprintf("GridFS.Close failed: %v", err))
+		return nil, err
+	}
+
+	removePreviousVersions(gfs, f)
+	return svc.objectInfo(f), nil
+}
+
+// CreateObject create object
+func (svc *Service) CreateObject(objectName string, file io.Reader, contentType string) (*storage.ObjectInfo, error) {
+	return svc.NewObject(objectName, file, contentType)
+}
+
+// SaveObject saves the data with a unique random name
+func (svc *Service) SaveObject(file io.Reader) (*storage.ObjectInfo, error) {
+	objectName := helpers.RandString6(storage.RandObjNameLength)
+	return svc.NewObject(objectName, file, "application/octet-stream")
+}
+
+// CreatePublicObject creates the object in the public storage/folder
+func (svc *Service) CreatePublicObject(objectName string, file io.Reader, contentType string) (*storage.ObjectInfo, error) {
+	objectName = fmt.Sprintf("%s/%s", svc.PublicPath, objectName)
+	return svc.NewObject(objectName, file, contentType)
+}
+
+// SavePublicObject save the object in public storage
+func (svc *Service) SavePublicObject(file io.Reader) (*storage.ObjectInfo, error) {
+	return svc.CreatePublicObject(
+		helpers.RandString6(storage.RandObjNameLength),
+		file,
+		"application/octet-stream",
+	)
+}
+
+// CopyObject copy object
+func (svc *Service) CopyObject(srcObjectName, dstObjectName string) (*storage.ObjectInfo, error) {
+	sc, gfs := svc.begin()
+	defer sc.Close()
+
+	src, err := gfs.Open(srcObjectName)
+	if err != nil {
+		utils.Error(fmt.Sprintf("GridFS.Open in gridfs.CopyObject failed: %v", err))
+		return nil, err
+	}
+	defer src.Close()
+
+	return svc.NewObject(dstObjectName, src, src.ContentType())
+}
+
+// DownloadObjectDest save object to file system
+func (svc *Service) DownloadObjectDest(objectName, destFilename string) (string, error) {
+	file, err := svc.GetObject(objectName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	localPath := storage.NewTempFile(destFilename)
+	output, err := os.Create(localPath)
+	if err != nil {
+		utils.Error(fmt.Sprintf("Error DownloadObjectDest While Creating file %v error=%v", localPath, err))
+		return "", err
+	}
+	defer output.Close()
+
+	n, err := io.Copy(output, file)
+	if err != nil {
+		return "", err
+	}
+
+	utils.Info(fmt.Sprintf("%v bytes downloaded for %v ", n, objectName))
+	return localPath, nil
+}
+
+// DownloadObject save object to file system with a uniques name
+func (svc *Service) DownloadObject(objectName string) (localPath string, err error) {
+	destFilename := helpers.RandString6(storage.RandObjNameLength)
+	return svc.DownloadObjectDest(objectName, destFilename)
+}
+
+// GetObject get object from storage, closing the reader releases its session
+func (svc *Service) GetObject(objectName string) (io.ReadCloser, error) {
+	sc, gfs := svc.begin()
+
+	f, err := gfs.Open(objectName)
+	if err != nil {
+		sc.Close()
+		utils.Warn(fmt.Sprintf("error GetObject '%s/%s': %v", svc.BucketName, objectName, err))
+		return nil, err
+	}
+
+	return &objectReader{GridFile: f, session: sc}, nil
+}
+
+// DeleteObject base function for deleting objects from storage
+func (svc *Service) DeleteObject(objectName string) error {
+	sc, gfs := svc.begin()
+	defer sc.Close()
+
+	if err := gfs.Remove(objectName); err != nil {
+		utils.Warn(fmt.Sprintf("error DeleteObject: %v[%v/%v]", err, svc.BucketName, objectName))
+		return err
+	}
+	return nil
+}
+
+// GetObjectInfo get object info
+func (svc *Service) GetObjectInfo(objectName string) (*storage.ObjectInfo, error) {
+	sc, gfs := svc.begin()
+	defer sc.Close()
+
+	f, err := gfs.Open(objectName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return svc.objectInfo(f), nil
+}
+
+func (svc *Service) begin() (*mgo.Session, *mgo.GridFS) {
+	sc := database.SessionCopy()
+
+	db := svc.Database
+	if db == "" {
+		db = database.Db
+	}
+
+	bucket := svc.BucketName
+	if bucket == "" {
+		bucket = DefaultBucketName
+	}
+
+	return sc, sc.DB(db).GridFS(bucket)
+}
+
+func (svc *Service) objectInfo(f *mgo.GridFile) *storage.ObjectInfo {
+	return &storage.ObjectInfo{
+		Name:         f.Name(),
+		MediaLink:    fmt.Sprintf("/storage/%s/%s", svc.BucketName, f.Name()),
+		SelfLink:     fmt.Sprintf("%s/%s", svc.BucketName, f.Name()),
+		ContentType:  f.ContentType(),
+		Size:         uint64(f.Size()),
+		ETag:         f.MD5(),
+		LastModified: f.UploadDate(),
+	}
+}
+
+// removePreviousVersions remove the files of the name of f uploaded before it, GridFS keeps
+// every version while the other services overwrite the object
+func removePreviousVersions(gfs *mgo.GridFS, f *mgo.GridFile) {
+	name := f.Name()
+	iter := gfs.Find(bson.M{
+		"filename":   name,
+		"_id":        bson.M{"$ne": f.Id()},
+		"uploadDate": bson.M{"$lte": f.UploadDate()},
+	}).Select(bson.M{"_id": 1}).Iter()
+
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	for iter.Next(&doc) {
+		if err := gfs.RemoveId(doc.ID); err != nil {
+			utils.Warn(fmt.Sprintf("error removing previous version of %v: %v", name, err))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		utils.Warn(fmt.Sprintf("error listing previous versions of %v: %v", name, err))
+	}
+}
@@ -0,0 +1,25 @@
+package gridfs
+
+import (
+	mgo "github.com/globalsign/mgo"
+)
+
+// objectReader GridFS file holding its session until closed
+type objectReader struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (r *objectReader) Close() error {
+	defer r.session.Close()
+	return r.GridFile.Close()
+}
+
+// ensureIndexes indexes of the GridFS lookups by name and of the chunk reads
+func ensureIndexes(gfs *mgo.GridFS) error {
+	if err := gfs.Files.EnsureIndex(mgo.Index{Key: []string{"filename", "uploadDate"}, Background: true}); err != nil {
+		return err
+	}
+
+	return gfs.Chunks.EnsureIndex(mgo.Index{Key: []string{"files_id", "n"}, Unique: true})
+}